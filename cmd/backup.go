@@ -23,10 +23,21 @@ var BackupCmd = &cobra.Command{
 
 func init() {
 	//Backup
-	BackupCmd.PersistentFlags().StringP("storage", "s", "local", "Storage. local or s3")
+	BackupCmd.PersistentFlags().StringP("storage", "s", "local", "Storage. local, s3, ssh or ftp, or a comma separated list. eg: local,s3")
 	BackupCmd.PersistentFlags().StringP("path", "P", "", "AWS S3 path without file name. eg: /custom_path or ssh remote path `/home/foo/data`")
-	BackupCmd.PersistentFlags().StringP("file", "f", "", "Backup a single file. eg: config.json")
+	BackupCmd.PersistentFlags().StringArrayP("file", "f", nil, "Backup files or directories instead of the whole volume, globs are supported and the flag can be repeated. eg: config.json")
+	BackupCmd.PersistentFlags().StringArrayP("source", "", nil, "Backup a folder of /data as a separate artifact, can be repeated. eg: --source app=/data/app")
+	BackupCmd.PersistentFlags().StringP("config", "c", "", "Configuration file of the sources")
+	BackupCmd.PersistentFlags().StringP("mode", "m", "", "Backup mode. full, incremental or differential, default full")
+	BackupCmd.PersistentFlags().StringP("full-every", "", "", "Create a full backup every N backups, or every N days. eg: 10 or 7d")
+	BackupCmd.PersistentFlags().StringP("format", "", "", "Backup format. archive or repository, default archive")
+	BackupCmd.PersistentFlags().StringArrayP("include", "", nil, "Only backup the paths matching the pattern, can be repeated. eg: --include 'app/*.db'")
+	BackupCmd.PersistentFlags().StringArrayP("exclude", "", nil, "Exclude the paths matching the pattern, can be repeated. eg: --exclude node_modules/ --exclude '*.lock'")
+	BackupCmd.PersistentFlags().StringP("compression", "", "", "Compression codec. gzip, zstd, xz, lz4 or none, default gzip")
+	BackupCmd.PersistentFlags().StringP("compression-level", "", "", "Compression level, default is the codec default")
+	BackupCmd.PersistentFlags().StringP("split-size", "", "", "Split the backup into volumes of this size. eg: 4GiB")
 	BackupCmd.PersistentFlags().StringP("cron-expression", "", "", "Backup cron expression")
 	BackupCmd.PersistentFlags().BoolP("prune", "", false, "Delete old data, default disabled")
+	BackupCmd.PersistentFlags().BoolP("consistent", "", false, "Copy data to a temporary folder before creating the archive, default disabled")
 
 }
@@ -0,0 +1,32 @@
+// Package cmd /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package cmd
+
+import (
+	"github.com/jkaninda/volume-backup/pkg"
+	"github.com/jkaninda/volume-backup/utils"
+	"github.com/spf13/cobra"
+)
+
+var ListCmd = &cobra.Command{
+	Use:     "list",
+	Short:   "List backups",
+	Example: utils.ListExample,
+	Run: func(cmd *cobra.Command, args []string) {
+		pkg.StartList(cmd)
+	},
+}
+
+func init() {
+	//List
+	ListCmd.PersistentFlags().StringP("storage", "s", "local", "Storage. local, s3, ssh or ftp")
+	ListCmd.PersistentFlags().StringP("path", "P", "", "AWS S3 path without file name. eg: /custom_path or ssh remote path `/home/foo/data`")
+	ListCmd.PersistentFlags().StringP("source", "", "", "List the backups of a source. eg: app")
+	ListCmd.PersistentFlags().StringP("config", "c", "", "Configuration file of the sources")
+	ListCmd.PersistentFlags().StringP("output", "o", "table", "Output format. table or json")
+
+}
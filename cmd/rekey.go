@@ -0,0 +1,33 @@
+// Package cmd /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package cmd
+
+import (
+	"github.com/jkaninda/volume-backup/pkg"
+	"github.com/jkaninda/volume-backup/utils"
+	"github.com/spf13/cobra"
+)
+
+var RekeyCmd = &cobra.Command{
+	Use:     "rekey",
+	Short:   "Encrypt stored backups with a new passphrase or new keys",
+	Example: utils.RekeyExample,
+	Run: func(cmd *cobra.Command, args []string) {
+		pkg.StartRekey(cmd)
+	},
+}
+
+func init() {
+	//Rekey
+	RekeyCmd.PersistentFlags().StringP("storage", "s", "local", "Storage. local, s3, ssh or ftp")
+	RekeyCmd.PersistentFlags().StringP("path", "P", "", "AWS S3 path without file name. eg: /custom_path or ssh remote path `/home/foo/data`")
+	RekeyCmd.PersistentFlags().StringP("file", "f", "", "Backup file name")
+	RekeyCmd.PersistentFlags().StringP("source", "", "", "Rekey the backups of a source. eg: app")
+	RekeyCmd.PersistentFlags().StringP("config", "c", "", "Configuration file of the sources")
+	RekeyCmd.PersistentFlags().BoolP("all", "", false, "Rekey all the encrypted files")
+
+}
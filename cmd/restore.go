@@ -23,8 +23,20 @@ var RestoreCmd = &cobra.Command{
 
 func init() {
 	//Restore
-	RestoreCmd.PersistentFlags().StringP("storage", "s", "local", "Storage. local or s3")
+	RestoreCmd.PersistentFlags().StringP("storage", "s", "local", "Storage. local, s3, ssh or ftp")
 	RestoreCmd.PersistentFlags().StringP("path", "P", "", "AWS S3 path without file name. eg: /custom_path or ssh remote path `/home/foo/data`")
-	RestoreCmd.PersistentFlags().StringP("file", "f", "", "File name of database")
+	RestoreCmd.PersistentFlags().StringP("source", "", "", "Restore a source backup to its folder. eg: app")
+	RestoreCmd.PersistentFlags().StringP("config", "c", "", "Configuration file of the sources")
+	RestoreCmd.PersistentFlags().StringP("file", "f", "", "Backup file name")
+	RestoreCmd.PersistentFlags().StringArrayP("member", "", nil, "Only restore this path of the backup with its content, globs are supported and the flag can be repeated. eg: config/app.json")
+	RestoreCmd.PersistentFlags().StringArrayP("include", "", nil, "Only restore the paths matching the pattern, can be repeated. eg: --include 'tenants/acme/**'")
+	RestoreCmd.PersistentFlags().StringArrayP("exclude", "", nil, "Do not restore the paths matching the pattern, can be repeated. eg: --exclude '*.log'")
+	RestoreCmd.PersistentFlags().BoolP("latest", "", false, "Restore the latest backup")
+	RestoreCmd.PersistentFlags().StringP("before", "", "", "Restore the latest backup created before this time. eg: \"2024-10-01 12:00\"")
+	RestoreCmd.PersistentFlags().StringP("target", "", "", "Directory to restore to, the data path or the source folder by default. eg: /data/restored")
+	RestoreCmd.PersistentFlags().StringP("strategy", "", "", "Restore strategy. merge (default), clean, skip-existing or fail-if-not-empty")
+	RestoreCmd.PersistentFlags().BoolP("dry-run", "", false, "List the files the restore would create, overwrite or delete, without writing anything")
+	RestoreCmd.PersistentFlags().StringP("output", "o", "", "Dry run output format. table (default) or json")
+	RestoreCmd.PersistentFlags().BoolP("allow-unsigned", "", false, "Restore backups that are not signed or do not match their signature")
 
 }
@@ -7,6 +7,7 @@
 package cmd
 
 import (
+	"github.com/jkaninda/volume-backup/utils"
 	"github.com/spf13/cobra"
 	"os"
 )
@@ -17,7 +18,7 @@ var rootCmd = &cobra.Command{
 	Short:   "Volume Backup tool, data data to AWS S3 or SSH Remote Server",
 	Long:    `Volume data and restoration tool. Backup database to AWS S3 storage, any S3 Alternatives for Object Storage or SSH remote server.`,
 	Example: "",
-	Version: appVersion,
+	Version: utils.AppVersion,
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -33,4 +34,7 @@ func init() {
 	rootCmd.AddCommand(VersionCmd)
 	rootCmd.AddCommand(BackupCmd)
 	rootCmd.AddCommand(RestoreCmd)
+	rootCmd.AddCommand(VerifyCmd)
+	rootCmd.AddCommand(RekeyCmd)
+	rootCmd.AddCommand(ListCmd)
 }
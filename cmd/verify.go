@@ -0,0 +1,36 @@
+// Package cmd /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package cmd
+
+import (
+	"github.com/jkaninda/volume-backup/pkg"
+	"github.com/jkaninda/volume-backup/utils"
+	"github.com/spf13/cobra"
+)
+
+var VerifyCmd = &cobra.Command{
+	Use:     "verify",
+	Short:   "Verify that backups can be restored",
+	Example: utils.VerifyExample,
+	Run: func(cmd *cobra.Command, args []string) {
+		pkg.StartVerify(cmd)
+	},
+}
+
+func init() {
+	//Verify
+	VerifyCmd.PersistentFlags().StringP("storage", "s", "local", "Storage. local, s3, ssh or ftp")
+	VerifyCmd.PersistentFlags().StringP("path", "P", "", "AWS S3 path without file name. eg: /custom_path or ssh remote path `/home/foo/data`")
+	VerifyCmd.PersistentFlags().StringP("file", "f", "", "Backup file name")
+	VerifyCmd.PersistentFlags().StringP("source", "", "", "Verify the backups of a source. eg: app")
+	VerifyCmd.PersistentFlags().StringP("config", "c", "", "Configuration file of the sources")
+	VerifyCmd.PersistentFlags().BoolP("latest", "", false, "Verify the latest backup")
+	VerifyCmd.PersistentFlags().BoolP("all", "", false, "Verify all the backups")
+	VerifyCmd.PersistentFlags().StringP("cron-expression", "", "", "Verification cron expression")
+	VerifyCmd.PersistentFlags().BoolP("allow-unsigned", "", false, "Accept backups that are not signed or do not match their signature")
+
+}
@@ -8,12 +8,10 @@ package cmd
 
 import (
 	"fmt"
+	"github.com/jkaninda/volume-backup/utils"
 	"github.com/spf13/cobra"
-	"os"
 )
 
-var appVersion = os.Getenv("VERSION")
-
 var VersionCmd = &cobra.Command{
 	Use:   "version",
 	Short: "Show version",
@@ -23,6 +21,6 @@ var VersionCmd = &cobra.Command{
 }
 
 func Version() {
-	fmt.Printf("Version: %s \n", appVersion)
+	fmt.Printf("Version: %s \n", utils.AppVersion)
 	fmt.Println()
 }
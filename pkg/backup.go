@@ -8,13 +8,10 @@ package pkg
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"github.com/jkaninda/encryptor"
-	"github.com/jkaninda/go-storage/pkg/ftp"
-	"github.com/jkaninda/go-storage/pkg/local"
-	"github.com/jkaninda/go-storage/pkg/s3"
-	"github.com/jkaninda/go-storage/pkg/ssh"
 	"github.com/jkaninda/volume-backup/utils"
 	"github.com/robfig/cron/v3"
 	"github.com/spf13/cobra"
@@ -30,7 +27,11 @@ func StartBackup(cmd *cobra.Command) {
 	config := initBackupConfig(cmd)
 
 	if config.cronExpression == "" {
-		BackupTask(config)
+		// Failures are reported for each storage, the exit code is set once every source is backed up
+		if err := runBackup(config); err != nil {
+			utils.Error("Backup failed: %v", err)
+			os.Exit(1)
+		}
 	} else {
 		if utils.IsValidCronExpression(config.cronExpression) {
 			scheduledMode(config)
@@ -45,18 +46,22 @@ func StartBackup(cmd *cobra.Command) {
 func scheduledMode(config *BackupConfig) {
 	utils.Info("Running in Scheduled mode")
 	utils.Info("Backup cron expression:  %s", config.cronExpression)
-	utils.Info("Storage type %s ", config.storage)
+	utils.Info("Storage type %s ", storagesName(config.storages))
 
 	//Test data
 	utils.Info("Testing data configurations...")
-	BackupTask(config)
+	if err := runBackup(config); err != nil {
+		utils.Error("Backup failed: %v", err)
+	}
 	utils.Info("Testing data configurations...done")
 	utils.Info("Creating data job...")
 	// Create a new cron instance
 	c := cron.New()
 
 	_, err := c.AddFunc(config.cronExpression, func() {
-		BackupTask(config)
+		if err := runBackup(config); err != nil {
+			utils.Error("Backup failed: %v", err)
+		}
 	})
 	if err != nil {
 		return
@@ -68,440 +73,334 @@ func scheduledMode(config *BackupConfig) {
 	defer c.Stop()
 	select {}
 }
-func BackupTask(config *BackupConfig) {
+
+// runBackup backs up the data path, or each source in multi-source mode.
+// Encryption and signing keys are read for each run, passphrases are cleared from memory once the run is done.
+// It returns an error if the backup is missing from a storage.
+func runBackup(config *BackupConfig) error {
+	config.encrypter = loadEncrypter()
+	defer config.encrypter.wipe()
+	config.signer = loadSigner()
+	defer config.signer.wipe()
+	defer wipeRestoreKeys()
+	if len(config.sources) > 0 {
+		return backupSources(config)
+	}
+	return BackupTask(config)
+}
+
+// BackupTask backs up the data path or a source to every storage, failed storages are reported and returned as an error
+func BackupTask(config *BackupConfig) error {
 	utils.Info("Starting backup task...")
+	dests := openDestinations(config)
+	if len(dests.active()) == 0 {
+		_ = dests.report(config, time.Now().Format(utils.TimeFormat()))
+		return errors.New("no storage to upload the backup to")
+	}
+	if config.format == formatRepository {
+		return repositoryBackups(config, dests)
+	}
 	//Generate file name
-	backupFileName := fmt.Sprintf("%s_%s.tar.gz", config.prefix, time.Now().Format("20060102_150405"))
+	extension := archiveExtension(config.compression.codec)
+	backupFileName := fmt.Sprintf("%s_%s.%s", config.prefix, time.Now().Format("20060102_150405"), extension)
 	if !config.fromFolder {
-		backupFileName = fmt.Sprintf("%s_%s.tar.gz", config.file, time.Now().Format("20060102_150405"))
+		backupFileName = fmt.Sprintf("%s_%s.%s", filesBackupName(config), time.Now().Format("20060102_150405"), extension)
 	}
 	config.backupFileName = backupFileName
-	switch config.storage {
-	case "local":
-		localBackup(config)
-	case "s3":
-		s3Backup(config)
-	case "ssh", "remote":
-		sshBackup(config)
-	case "ftp":
-		ftpBackup(config)
-	default:
-		localBackup(config)
+	if config.fromFolder {
+		base, sequence := loadBaseSnapshot(config.prefix, config.mode, config.fullEvery)
+		mode := config.mode
+		if base == nil {
+			mode = modeFull
+		}
+		config.snapshot = newSnapshotIndex(mode, base)
+		config.snapshot.Sequence = sequence
+		utils.Info("Backup mode: %s", mode)
 	}
+	return archiveBackup(config, dests)
 }
 func intro() {
 	utils.Info("Starting Volume Backup...")
 	utils.Info("Copyright (c) 2024 Jonas Kaninda ")
 }
 
-// BackupData backup data
-func BackupData(config *BackupConfig) {
+// BackupData creates the backup archive in the temp directory
+func BackupData(config *BackupConfig) error {
 	utils.Info("Starting data backup...")
+	manifest := newBackupManifest(config)
 	if !config.fromFolder {
-		err := compressFile(config.file, config.backupFileName)
+		err := compressFiles(config.files, config.backupFileName, config.compression, manifest, config.encrypter)
 		if err != nil {
-			utils.Fatal("Error compressing file, error %v", err)
+			return fmt.Errorf("error compressing files: %w", err)
 		}
 	} else {
-		err := utils.CopyDir(dataPath, dataTmpPath)
-		if err != nil {
-			utils.Fatal("Error copying file, error %v", err)
+		sourceFolder := config.sourcePath
+		// In consistent mode, data is staged into a temporary copy first,
+		// otherwise the archive is streamed straight from the volume
+		if config.consistent {
+			utils.Info("Consistent mode enabled, copying data to %s ...", dataTmpPath)
+			err := utils.CopyDir(config.sourcePath, dataTmpPath)
+			defer deleteDataTemp()
+			if err != nil {
+				return fmt.Errorf("error copying data to %s: %w", dataTmpPath, err)
+			}
+			sourceFolder = dataTmpPath
+			config.snapshot.root = config.sourcePath
 		}
-		err = compressFolder(dataTmpPath, config.backupFileName)
+		err := compressFolder(sourceFolder, config.backupFileName, config.compression, config.filter, config.snapshot, manifest, config.encrypter)
 		if err != nil {
-			utils.Fatal("Error creating file, error %v", err)
+			return fmt.Errorf("error creating archive: %w", err)
 		}
 	}
-	// Backup data
-	utils.Info("Backing up data...")
 	utils.Info("Data has been backed up")
-
+	return nil
 }
-func localBackup(config *BackupConfig) {
-	utils.Info("Backup data to local storage")
+
+// archiveBackup creates the backup archive once and uploads it with its snapshot index to every storage
+func archiveBackup(config *BackupConfig, dests destinations) error {
+	utils.Info("Backup data to %s storage", storagesName(config.storages))
 	startTime = time.Now().Format(utils.TimeFormat())
-	BackupData(config)
-	finalFileName := config.backupFileName
-	if config.encryption && config.passphrase != "" {
-		encryptBackup(config.backupFileName, config.passphrase)
-		finalFileName = fmt.Sprintf("%s.%s", config.backupFileName, gpgExtension)
+	finalFileName := config.archiveName()
+	err := BackupData(config)
+	var fileInfo os.FileInfo
+	if err == nil {
+		utils.Info("Backup name is %s", finalFileName)
+		//Get backup info
+		fileInfo, err = os.Stat(filepath.Join(tmpPath, finalFileName))
 	}
-	utils.Info("Backup name is %s", finalFileName)
-	//Get backup info
-	fileInfo, err := os.Stat(filepath.Join(tmpPath, finalFileName))
 	if err != nil {
-		utils.Error("Error:", err)
+		// The archive is missing from every storage
+		dests.fail(err)
+		_ = dests.report(config, startTime)
+		deleteTemp()
+		return err
 	}
 	backupSize = fileInfo.Size()
-
-	//moveToBackup(finalFileName, backupDestination)
-	localStorage := local.NewStorage(local.Config{
-		LocalPath:  tmpPath,
-		RemotePath: backupDestination,
-	})
-	err = localStorage.Copy(finalFileName)
+	utils.Info("Uploading backup archive to %s storage ... ", storagesName(config.storages))
+	err = copyArchive(dests, config, finalFileName)
+	if err == nil {
+		err = copySnapshotIndex(dests, config, finalFileName)
+	}
 	if err != nil {
-		utils.Fatal("Error copying file, error %v", err)
+		_ = dests.report(config, startTime)
+		deleteTemp()
+		return fmt.Errorf("error uploading backup archive: %w", err)
+	}
+	utils.Done("Uploading backup archive to %s storage ... done ", storagesName(config.storages))
+	for _, d := range dests {
+		d.file, d.size = finalFileName, backupSize
 	}
-	//Send notification
-	utils.NotifySuccess(&utils.NotificationData{
-		File:           finalFileName,
-		BackupSize:     backupSize,
-		Storage:        config.storage,
-		BackupLocation: filepath.Join(config.remotePath, finalFileName),
-		StartTime:      startTime,
-		EndTime:        time.Now().Format(utils.TimeFormat()),
-	})
 	//Delete old data
 	if config.prune {
-		err := localStorage.Prune(config.backupRetention)
-		if err != nil {
-			utils.Error("Error pruning file, error %v", err)
-			return
-		}
+		dests.prune()
 	}
+	//Send notifications
+	err = dests.report(config, startTime)
 	//Delete temp
-	deleteDataTemp()
 	deleteTemp()
+	return err
 }
 
-func s3Backup(config *BackupConfig) {
-	utils.Info("Backup data to s3 storage")
-	startTime = time.Now().Format(utils.TimeFormat())
-	awsConfig := initAWSConfig()
-	//Backup data
-	BackupData(config)
-	finalFileName := config.backupFileName
-	if config.encryption {
-		encryptBackup(config.backupFileName, config.passphrase)
-		finalFileName = fmt.Sprintf("%s.%s", config.backupFileName, "gpg")
-	}
-	utils.Info("Uploading backup archive to remote storage S3 ... ")
-
-	utils.Info("Backup name is %s", finalFileName)
-	s3Storage, err := s3.NewStorage(s3.Config{
-		Endpoint:       awsConfig.endpoint,
-		Bucket:         awsConfig.bucket,
-		AccessKey:      awsConfig.accessKey,
-		SecretKey:      awsConfig.secretKey,
-		Region:         awsConfig.region,
-		DisableSsl:     awsConfig.disableSsl,
-		ForcePathStyle: awsConfig.forcePathStyle,
-		RemotePath:     awsConfig.remotePath,
-		LocalPath:      tmpPath,
-	})
-	if err != nil {
-		utils.Fatal("Error creating s3 storage: %s", err)
-	}
-	err = s3Storage.Copy(finalFileName)
-	if err != nil {
-		utils.Fatal("Error copying file, error %v", err)
-	}
-	//Get backup info
-	fileInfo, err := os.Stat(filepath.Join(tmpPath, finalFileName))
+// encryptBackup encrypts a file of the temp directory while it is read, only the encrypted file is kept
+func encryptBackup(backupFileName string, enc *encrypter) {
+	err := encryptTempFile(backupFileName, enc)
 	if err != nil {
-		utils.Error("Error:", err)
-	}
-	backupSize = fileInfo.Size()
-
-	//Delete data file from tmp folder
-	err = utils.DeleteFile(filepath.Join(tmpPath, config.backupFileName))
-	if err != nil {
-		fmt.Println("Error deleting file: ", err)
-
-	}
-	// Delete old data
-	if config.prune {
-		err := s3Storage.Prune(config.backupRetention)
-		if err != nil {
-			utils.Fatal("Error deleting old backup from S3: %s ", err)
-		}
+		utils.Fatal("Error during encrypting backup %v", err)
 	}
-	utils.Done("Uploading backup archive to remote storage S3 ... done ")
-	//Send notification
-	utils.NotifySuccess(&utils.NotificationData{
-		File:           finalFileName,
-		BackupSize:     backupSize,
-		Storage:        config.storage,
-		BackupLocation: filepath.Join(config.remotePath, finalFileName),
-		StartTime:      startTime,
-		EndTime:        time.Now().Format(utils.TimeFormat()),
-	})
-	//Delete temp
-	deleteDataTemp()
-	deleteTemp()
 }
-func sshBackup(config *BackupConfig) {
-	utils.Info("Backup data to Remote server")
-	startTime = time.Now().Format(utils.TimeFormat())
 
-	//Backup data
-	BackupData(config)
-	finalFileName := config.backupFileName
-	if config.encryption {
-		encryptBackup(config.backupFileName, config.passphrase)
-		finalFileName = fmt.Sprintf("%s.%s", config.backupFileName, "gpg")
-	}
-	utils.Info("Uploading backup archive to remote storage ... ")
-	utils.Info("Backup name is %s", finalFileName)
-	sshConfig, err := loadSSHConfig()
-	if err != nil {
-		utils.Fatal("Error loading ssh config: %s", err)
-	}
-	sshStorage, err := ssh.NewStorage(ssh.Config{
-		Host:         sshConfig.hostName,
-		Port:         sshConfig.port,
-		User:         sshConfig.user,
-		Password:     sshConfig.password,
-		IdentifyFile: sshConfig.identifyFile,
-		RemotePath:   config.remotePath,
-		LocalPath:    tmpPath,
+// Compresses a folder into a .tar file, only paths selected by the filter and changed since the snapshot base are archived.
+// Files are hashed by a first pass, the complete manifest is the first member and the files are archived by a second pass.
+// With encryption, the archive is encrypted while it is written, no plain archive is written to the temp directory.
+func compressFolder(sourceFolder, fileName string, c compression, filter *pathFilter, snapshot *snapshotIndex, manifest *backupManifest, enc *encrypter) error {
+	plan := newArchivePlan(manifest)
+	// Walk through the source folder, files are hashed as they are read
+	err := walkFiltered(sourceFolder, filter, func(path, relPath string, info os.FileInfo) error {
+		if info.Mode()&os.ModeSocket != 0 {
+			utils.Warn("Skipping socket %s", relPath)
+			return nil
+		}
+		if snapshot != nil && !snapshot.track(relPath, info) {
+			return nil
+		}
+		return plan.add(path, relPath, info)
 	})
 	if err != nil {
-		utils.Fatal("Error creating SSH storage: %s", err)
-	}
-	err = sshStorage.Copy(finalFileName)
-	if err != nil {
-		utils.Fatal("Error copying file, error %v", err)
-	}
-
-	//Get backup info
-	fileInfo, err := os.Stat(filepath.Join(tmpPath, finalFileName))
-	if err != nil {
-		utils.Error("Error:", err)
+		return err
 	}
-	backupSize = fileInfo.Size()
-
-	//Delete data file from tmp folder
-	err = utils.DeleteFile(filepath.Join(tmpPath, finalFileName))
-	if err != nil {
-		utils.Error("Error deleting file: %v", err)
+	return plan.write(fileName, c, enc)
+}
 
+// closeArchive flushes the tar and compression writers, compression errors are only reported on close
+func closeArchive(tarWriter *tar.Writer, compressWriter io.WriteCloser) error {
+	if err := tarWriter.Close(); err != nil {
+		return err
 	}
-	if config.prune {
-		err := sshStorage.Prune(config.backupRetention)
-		if err != nil {
-			utils.Error("Error pruning file, error %v", err)
-			return
-		}
-	}
-
-	utils.Done("Uploading backup archive to remote storage ... done ")
-	//Send notification
-	utils.NotifySuccess(&utils.NotificationData{
-		File:           finalFileName,
-		BackupSize:     backupSize,
-		Storage:        config.storage,
-		BackupLocation: filepath.Join(config.remotePath, finalFileName),
-		StartTime:      startTime,
-		EndTime:        time.Now().Format(utils.TimeFormat()),
-	})
-	//Delete temp
-	deleteDataTemp()
-	deleteTemp()
+	return compressWriter.Close()
 }
-func ftpBackup(config *BackupConfig) {
-	utils.Info("Backup data to the remote FTP server")
-	startTime = time.Now().Format(utils.TimeFormat())
 
-	//Backup database
-	BackupData(config)
-	finalFileName := config.backupFileName
-	if config.encryption {
-		encryptBackup(config.backupFileName, config.passphrase)
-		finalFileName = fmt.Sprintf("%s.%s", config.backupFileName, "gpg")
-	}
-	utils.Info("Uploading backup archive to the remote FTP server ... ")
-	utils.Info("Backup name is %s", finalFileName)
-	ftpConfig := initFtpConfig()
-	ftpStorage, err := ftp.NewStorage(ftp.Config{
-		Host:       ftpConfig.host,
-		Port:       ftpConfig.port,
-		User:       ftpConfig.user,
-		Password:   ftpConfig.password,
-		RemotePath: config.remotePath,
-		LocalPath:  tmpPath,
-	})
-	if err != nil {
-		utils.Fatal("Error creating FTP storage: %s", err)
-	}
-	err = ftpStorage.Copy(finalFileName)
-	if err != nil {
-		utils.Fatal("Error uploading file to the remote FTP server: %s ", err)
-	}
-	//Get backup info
-	fileInfo, err := os.Stat(filepath.Join(tmpPath, finalFileName))
-	if err != nil {
-		utils.Error("Error:", err)
+// copyFileContent copies exactly header.Size bytes of the file into the tar writer.
+// A file being written to while it is archived may grow or shrink, the archive
+// keeps the size recorded in the header and the content is truncated or padded.
+func copyFileContent(writer io.Writer, file *os.File, header *tar.Header) error {
+	n, err := io.CopyN(writer, file, header.Size)
+	if err == io.EOF {
+		utils.Warn("%s has shrunk during backup, padding %d bytes", header.Name, header.Size-n)
+		_, err = io.CopyN(writer, zeroReader{}, header.Size-n)
 	}
-	backupSize = fileInfo.Size()
-
-	//Delete data file from tmp folder
-	err = utils.DeleteFile(filepath.Join(tmpPath, finalFileName))
-	if err != nil {
-		utils.Error("Error deleting file: %v", err)
+	return err
+}
 
-	}
-	if config.prune {
-		err := ftpStorage.Prune(config.backupRetention)
-		if err != nil {
-			utils.Error("Error pruning file, error %v", err)
-			return
-		}
+// zeroReader is an io.Reader that returns an infinite stream of zero bytes
+type zeroReader struct{}
 
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
 	}
+	return len(p), nil
+}
 
-	utils.Done("Uploading backup archive to the remote FTP server ... done ")
-	//Send notification
-	utils.NotifySuccess(&utils.NotificationData{
-		File:           finalFileName,
-		BackupSize:     backupSize,
-		Storage:        config.storage,
-		BackupLocation: filepath.Join(config.remotePath, finalFileName),
-		StartTime:      startTime,
-		EndTime:        time.Now().Format(utils.TimeFormat()),
-	})
-	//Delete temp
-	deleteDataTemp()
-	deleteTemp()
+// archiveEntry is a path of an archive, listed and hashed by the first pass of a backup
+type archiveEntry struct {
+	path   string
+	header *tar.Header
+	sum    string
 }
 
-func encryptBackup(backupFileName, gpqPassphrase string) {
-	backupFile, err := os.ReadFile(filepath.Join(tmpPath, backupFileName))
-	outputFile := fmt.Sprintf("%s.%s", filepath.Join(tmpPath, backupFileName), gpgExtension)
-	if err != nil {
-		utils.Fatal("Error reading backup file: %s ", err)
-	}
-	err = encryptor.Encrypt(backupFile, outputFile, gpqPassphrase)
-	if err != nil {
-		utils.Fatal("Error during encrypting backup %v", err)
-	}
+// archivePlan lists the entries of an archive and records them in the manifest,
+// the manifest is written before the entries are archived
+type archivePlan struct {
+	entries  []archiveEntry
+	links    hardLinks
+	manifest *backupManifest
+}
 
+// newArchivePlan creates an empty archive plan
+func newArchivePlan(manifest *backupManifest) *archivePlan {
+	return &archivePlan{links: make(hardLinks), manifest: manifest}
 }
 
-// Compresses a folder into a .tar file
-func compressFolder(sourceFolder, fileName string) error {
-	// Create the output tar file
-	outFile, err := os.Create(filepath.Join(tmpPath, fileName))
+// add lists a path, named after its relative path, regular files are hashed
+func (p *archivePlan) add(path, relPath string, info os.FileInfo) error {
+	// Create a header for the tar file, named after the relative file path
+	header, err := fileHeader(path, relPath, info, p.links)
 	if err != nil {
 		return err
 	}
-	defer outFile.Close()
-
-	// Create a gzip writer
-	gzWriter := gzip.NewWriter(outFile)
-	defer gzWriter.Close()
-
-	// Create a tar writer
-	tarWriter := tar.NewWriter(gzWriter)
-	defer tarWriter.Close()
-
-	// Walk through the source folder
-	err = filepath.Walk(sourceFolder, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		// Get the relative path to maintain the folder structure
-		relPath, err := filepath.Rel(sourceFolder, path)
-		if err != nil {
-			return err
-		}
-
-		// Create a header for the tar file
-		header, err := tar.FileInfoHeader(info, info.Name())
-		if err != nil {
-			return err
-		}
-
-		// Update the header name to the relative file path
-		header.Name = relPath
-
-		// Write the header to the tar file
-		if err := tarWriter.WriteHeader(header); err != nil {
-			return err
-		}
-
-		// If it's a directory, there's no need to write any file content
-		if info.IsDir() {
-			return nil
-		}
-
-		// Open the file to be written to the tar file
+	var sum string
+	if header.Typeflag == tar.TypeReg {
 		file, err := os.Open(path)
 		if err != nil {
+			if os.IsNotExist(err) {
+				utils.Warn("%s has been removed during backup, skipping", path)
+				return nil
+			}
 			return err
 		}
 		defer file.Close()
-
-		// Copy the file data to the tar file
-		if _, err := io.Copy(tarWriter, file); err != nil {
+		h := sha256.New()
+		if err := copyFileContent(h, file, header); err != nil {
 			return err
 		}
-
-		return nil
-	})
-
-	if err != nil {
-		return err
+		sum = hex.EncodeToString(h.Sum(nil))
 	}
-
+	p.entries = append(p.entries, archiveEntry{path: path, header: header, sum: sum})
+	p.manifest.add(header, sum)
 	return nil
 }
 
-// Compresses a file into a .tar file
-func compressFile(sourceFile, fileName string) error {
-	//Exist file
-	if !utils.FileExists(filepath.Join(dataPath, sourceFile)) {
-		utils.Error("file %s does not exist  ", filepath.Join(dataPath, sourceFile))
-		return fmt.Errorf("file %s does not exist", sourceFile)
-	}
-	// Create the output file
-	outFile, err := os.Create(filepath.Join(tmpPath, fileName))
+// write creates the archive, the manifest is the first member. Files are hashed again while they are archived,
+// the backup fails if one of them has changed since it was listed.
+func (p *archivePlan) write(fileName string, c compression, enc *encrypter) error {
+	p.manifest.EndTime = time.Now().UTC()
+	// Create the archive, compressed and encrypted while it is written
+	archive, err := newArchiveWriter(fileName, c, p.manifest, enc)
 	if err != nil {
 		return err
 	}
-	defer outFile.Close()
-
-	// Create a gzip writer
-	gzWriter := gzip.NewWriter(outFile)
-	defer gzWriter.Close()
-
-	// Create a tar writer
-	tarWriter := tar.NewWriter(gzWriter)
-	defer tarWriter.Close()
-
-	// Open the source file to be added to the archive
-	file, err := os.Open(filepath.Join(dataPath, sourceFile))
-	if err != nil {
-		return err
+	for _, entry := range p.entries {
+		if err := addToArchive(archive.tar, entry); err != nil {
+			archive.abort()
+			return err
+		}
 	}
-	defer file.Close()
+	return archive.close()
+}
 
-	// Get the file's information (name, size, permissions, etc.)
-	info, err := file.Stat()
-	if err != nil {
-		return err
+// addToArchive writes a listed entry to the archive, the content of regular files must match their checksum
+func addToArchive(tarWriter *tar.Writer, entry archiveEntry) error {
+	header := entry.header
+	// If it's not a regular file, there's no need to write any file content
+	if header.Typeflag != tar.TypeReg {
+		return tarWriter.WriteHeader(header)
 	}
 
-	// Create a tar header from the file info
-	header, err := tar.FileInfoHeader(info, info.Name())
+	// Open the file to be written to the tar file
+	file, err := os.Open(entry.path)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s has been removed during backup, it is listed in the manifest", entry.path)
+		}
 		return err
 	}
+	defer file.Close()
 
-	// Update the header name to the base name of the file
-	header.Name = info.Name()
-
-	// Write the header to the tar archive
+	// Write the header to the tar file
 	if err := tarWriter.WriteHeader(header); err != nil {
 		return err
 	}
-
-	// Copy the file content into the tar archive
-	if _, err := io.Copy(tarWriter, file); err != nil {
+	h := sha256.New()
+	if err := copyFileContent(io.MultiWriter(tarWriter, h), file, header); err != nil {
 		return err
 	}
-
+	if hex.EncodeToString(h.Sum(nil)) != entry.sum {
+		return fmt.Errorf("%s has changed during backup, its content does not match the manifest", entry.path)
+	}
 	return nil
 }
+
+// Compresses files into a .tar file, patterns are globs relative to the data path and directories are archived recursively.
+// Paths relative to the data path are kept in the archive, the complete manifest is the first member.
+func compressFiles(patterns []string, fileName string, c compression, manifest *backupManifest, enc *encrypter) error {
+	var paths []string
+	for _, pattern := range patterns {
+		name, ok := memberPath(pattern)
+		if !ok {
+			return fmt.Errorf("file %s is not inside %s", pattern, dataPath)
+		}
+		matches, err := filepath.Glob(filepath.Join(dataPath, name))
+		if err != nil {
+			return fmt.Errorf("invalid file pattern %s: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			utils.Error("file %s does not exist  ", filepath.Join(dataPath, name))
+			return fmt.Errorf("file %s does not exist", pattern)
+		}
+		paths = append(paths, matches...)
+	}
+	plan := newArchivePlan(manifest)
+	// Patterns can overlap, each path is archived once
+	seen := make(map[string]bool)
+	for _, root := range paths {
+		err := walkFiltered(root, nil, func(path, _ string, info os.FileInfo) error {
+			relPath, err := filepath.Rel(dataPath, path)
+			if err != nil {
+				return err
+			}
+			if seen[relPath] {
+				return nil
+			}
+			seen[relPath] = true
+			if info.Mode()&os.ModeSocket != 0 {
+				utils.Warn("Skipping socket %s", relPath)
+				return nil
+			}
+			return plan.add(path, relPath, info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return plan.write(fileName, c, enc)
+}
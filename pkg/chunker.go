@@ -0,0 +1,132 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"io"
+)
+
+// Content-defined chunking parameters, changing them breaks deduplication with existing repositories
+const (
+	chunkMinSize = 512 * 1024
+	chunkAvgSize = 1024 * 1024
+	chunkMaxSize = 8 * 1024 * 1024
+	// chunkMaskS is used below the average size, it has more bits set to make cut points less likely
+	chunkMaskS = uint64(0xfffffc0000000000) // 22 bits
+	// chunkMaskL is used above the average size, it has fewer bits set to make cut points more likely
+	chunkMaskL = uint64(0xffffc00000000000) // 18 bits
+)
+
+// gearTable holds the random values of the gear rolling hash.
+// It is generated from a fixed seed so that chunk boundaries are stable across versions.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x766f6c756d652d62) // "volume-b"
+	for i := range table {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunker splits a stream into content-defined chunks using the FastCDC algorithm,
+// an insertion in a file only changes the chunks around it.
+type chunker struct {
+	reader io.Reader
+	buf    []byte
+	start  int
+	end    int
+	eof    bool
+}
+
+func newChunker(reader io.Reader) *chunker {
+	return &chunker{
+		reader: reader,
+		buf:    make([]byte, 2*chunkMaxSize),
+	}
+}
+
+// reset reuses the chunker buffer for a new stream
+func (c *chunker) reset(reader io.Reader) {
+	c.reader = reader
+	c.start = 0
+	c.end = 0
+	c.eof = false
+}
+
+// Next returns the next chunk, the returned slice is only valid until the next call.
+// It returns io.EOF when the stream is fully consumed.
+func (c *chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	data := c.buf[c.start:c.end]
+	n := cutPoint(data)
+	chunk := data[:n]
+	c.start += n
+	return chunk, nil
+}
+
+// fill makes sure the buffer holds at least chunkMaxSize bytes, unless the end of the stream is reached
+func (c *chunker) fill() error {
+	if c.eof || c.end-c.start >= chunkMaxSize {
+		return nil
+	}
+	// Move the remaining data to the beginning of the buffer
+	copy(c.buf, c.buf[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+	for c.end < len(c.buf) && !c.eof {
+		n, err := c.reader.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cutPoint returns the length of the first chunk of data
+func cutPoint(data []byte) int {
+	n := len(data)
+	if n <= chunkMinSize {
+		return n
+	}
+	if n > chunkMaxSize {
+		n = chunkMaxSize
+	}
+	normal := chunkAvgSize
+	if n < normal {
+		normal = n
+	}
+	var fp uint64
+	i := chunkMinSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&chunkMaskS == 0 {
+			return i
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&chunkMaskL == 0 {
+			return i
+		}
+	}
+	return n
+}
@@ -0,0 +1,127 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// randomBytes returns n pseudo-random bytes, the same for a given seed
+func randomBytes(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// chunks splits data with the chunker, the chunks are copied
+func chunks(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+	c := newChunker(bytes.NewReader(data))
+	var result [][]byte
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return result
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, bytes.Clone(chunk))
+	}
+}
+
+func TestChunkerCutPoints(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       []byte
+		wantChunks int
+	}{
+		{name: "empty", data: nil, wantChunks: 0},
+		{name: "smaller than the minimum size", data: randomBytes(1, 1000), wantChunks: 1},
+		{name: "minimum size", data: randomBytes(2, chunkMinSize), wantChunks: 1},
+		{name: "zeros are cut at the maximum size", data: make([]byte, 3*chunkMaxSize+10), wantChunks: 4},
+		{name: "random data", data: randomBytes(3, 24*1024*1024), wantChunks: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := chunks(t, tt.data)
+			if tt.wantChunks >= 0 && len(got) != tt.wantChunks {
+				t.Fatalf("%d chunks, want %d", len(got), tt.wantChunks)
+			}
+			for i, chunk := range got {
+				if len(chunk) > chunkMaxSize {
+					t.Errorf("chunk %d is %d bytes, more than the maximum size", i, len(chunk))
+				}
+				if i < len(got)-1 && len(chunk) < chunkMinSize {
+					t.Errorf("chunk %d is %d bytes, less than the minimum size", i, len(chunk))
+				}
+			}
+			if joined := bytes.Join(got, nil); !bytes.Equal(joined, tt.data) {
+				t.Errorf("chunks do not rebuild the data, %d of %d bytes", len(joined), len(tt.data))
+			}
+			// Cut points only depend on the content
+			if again := chunks(t, tt.data); len(again) != len(got) {
+				t.Errorf("%d chunks on the second pass, want %d", len(again), len(got))
+			}
+		})
+	}
+}
+
+func TestChunkerInsertion(t *testing.T) {
+	data := randomBytes(4, 24*1024*1024)
+	tests := []struct {
+		name   string
+		offset int
+		insert []byte
+	}{
+		{name: "insertion at the start", offset: 0, insert: []byte("inserted")},
+		{name: "insertion in the middle", offset: len(data) / 2, insert: randomBytes(5, 4096)},
+	}
+	original := chunks(t, data)
+	known := make(map[string]bool)
+	for _, chunk := range original {
+		known[string(chunk)] = true
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed := append(append(append([]byte{}, data[:tt.offset]...), tt.insert...), data[tt.offset:]...)
+			got := chunks(t, changed)
+			shared := 0
+			for _, chunk := range got {
+				if known[string(chunk)] {
+					shared++
+				}
+			}
+			// Only the chunks around the insertion change
+			if shared < len(original)-3 {
+				t.Errorf("%d of %d chunks unchanged after the insertion", shared, len(original))
+			}
+		})
+	}
+}
+
+func TestCutPoint(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{name: "short data is a single chunk", data: make([]byte, 100), want: 100},
+		{name: "minimum size", data: make([]byte, chunkMinSize), want: chunkMinSize},
+		{name: "no cut point before the maximum size", data: make([]byte, 2*chunkMaxSize), want: chunkMaxSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cutPoint(tt.data); got != tt.want {
+				t.Errorf("cutPoint() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+	"io"
+	"runtime"
+)
+
+const (
+	codecGzip = "gzip"
+	codecZstd = "zstd"
+	codecXz   = "xz"
+	codecLz4  = "lz4"
+	codecNone = "none"
+)
+
+// Magic bytes used to detect the codec of an archive on restore
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic   = []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}
+	lz4Magic  = []byte{0x04, 0x22, 0x4d, 0x18}
+)
+
+// compression holds the codec settings of a backup
+type compression struct {
+	codec string
+	// level is the codec compression level, used when levelSet is set
+	level int
+	// levelSet is set when a level is configured, the codec default is used otherwise
+	levelSet bool
+	// threads is the number of compression goroutines
+	threads int
+}
+
+// validCodec reports whether the codec is supported
+func validCodec(codec string) bool {
+	switch codec {
+	case codecGzip, codecZstd, codecXz, codecLz4, codecNone:
+		return true
+	}
+	return false
+}
+
+// archiveExtension returns the archive file extension of a codec
+func archiveExtension(codec string) string {
+	switch codec {
+	case codecZstd:
+		return "tar.zst"
+	case codecXz:
+		return "tar.xz"
+	case codecLz4:
+		return "tar.lz4"
+	case codecNone:
+		return "tar"
+	default:
+		return "tar.gz"
+	}
+}
+
+// nopWriteCloser writes archives without compression
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// newCompressWriter returns a writer compressing to w, closing it does not close w
+func newCompressWriter(w io.Writer, c compression) (io.WriteCloser, error) {
+	threads := c.threads
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+	switch c.codec {
+	case codecNone:
+		return nopWriteCloser{w}, nil
+	case codecZstd:
+		options := []zstd.EOption{zstd.WithEncoderConcurrency(threads)}
+		if c.levelSet {
+			options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.level)))
+		}
+		return zstd.NewWriter(w, options...)
+	case codecXz:
+		// xz is single threaded, the level sets the dictionary size like xz -0 to -9
+		config := xz.WriterConfig{}
+		if c.levelSet {
+			config.DictCap = xzDictCap(c.level)
+		}
+		return config.NewWriter(w)
+	case codecLz4:
+		writer := lz4.NewWriter(w)
+		options := []lz4.Option{lz4.ConcurrencyOption(threads)}
+		if c.levelSet {
+			level, err := lz4Level(c.level)
+			if err != nil {
+				return nil, err
+			}
+			options = append(options, lz4.CompressionLevelOption(level))
+		}
+		if err := writer.Apply(options...); err != nil {
+			return nil, err
+		}
+		return writer, nil
+	default:
+		level := pgzip.DefaultCompression
+		if c.levelSet {
+			level = c.level
+		}
+		writer, err := pgzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		// Blocks of 1MB are compressed in parallel
+		if err := writer.SetConcurrency(1<<20, threads); err != nil {
+			return nil, err
+		}
+		return writer, nil
+	}
+}
+
+// xzDictCap returns the dictionary size of an xz preset level
+func xzDictCap(level int) int {
+	sizes := []int{256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+	if level >= len(sizes) {
+		level = len(sizes) - 1
+	}
+	return sizes[level]
+}
+
+// lz4Level converts a level from 0 to 9 to an lz4 compression level, 0 is the fast mode
+func lz4Level(level int) (lz4.CompressionLevel, error) {
+	levels := []lz4.CompressionLevel{lz4.Fast, lz4.Level1, lz4.Level2, lz4.Level3, lz4.Level4, lz4.Level5, lz4.Level6, lz4.Level7, lz4.Level8, lz4.Level9}
+	if level >= len(levels) {
+		return 0, fmt.Errorf("lz4 compression level must be between 0 and 9")
+	}
+	return levels[level], nil
+}
+
+// newDecompressReader returns a reader decompressing r, the codec is detected from its magic bytes.
+// Streams matching no known codec are read as uncompressed tar archives.
+func newDecompressReader(r io.Reader) (io.ReadCloser, string, error) {
+	reader := bufio.NewReader(r)
+	magic, err := reader.Peek(len(xzMagic))
+	if err != nil && err != io.EOF {
+		return nil, "", err
+	}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gzReader, err := pgzip.NewReader(reader)
+		return gzReader, codecGzip, err
+	case bytes.HasPrefix(magic, zstdMagic):
+		zstdReader, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, codecZstd, err
+		}
+		return zstdReader.IOReadCloser(), codecZstd, nil
+	case bytes.HasPrefix(magic, xzMagic):
+		xzReader, err := xz.NewReader(reader)
+		return io.NopCloser(xzReader), codecXz, err
+	case bytes.HasPrefix(magic, lz4Magic):
+		return io.NopCloser(&lz4FramesReader{src: reader, reader: lz4.NewReader(reader)}), codecLz4, nil
+	default:
+		return io.NopCloser(reader), codecNone, nil
+	}
+}
+
+// lz4FramesReader reads concatenated lz4 frames as a single stream, like the other codecs readers do
+type lz4FramesReader struct {
+	src    *bufio.Reader
+	reader *lz4.Reader
+}
+
+func (r *lz4FramesReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.reader.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		// The end of a frame, the next one is read if any
+		if _, peekErr := r.src.Peek(1); peekErr != nil {
+			return n, err
+		}
+		r.reader.Reset(r.src)
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestCompressionLevels(t *testing.T) {
+	data := bytes.Repeat([]byte("volume-backup compression level "), 32*1024)
+	tests := []struct {
+		name    string
+		c       compression
+		wantErr bool
+		// stored is set when the data is not compressed
+		stored bool
+	}{
+		{name: "gzip default", c: compression{codec: codecGzip}},
+		{name: "gzip level 0", c: compression{codec: codecGzip, level: 0, levelSet: true}, stored: true},
+		{name: "gzip level 9", c: compression{codec: codecGzip, level: 9, levelSet: true}},
+		{name: "gzip invalid level", c: compression{codec: codecGzip, level: 10, levelSet: true}, wantErr: true},
+		{name: "zstd default", c: compression{codec: codecZstd}},
+		{name: "zstd level 0", c: compression{codec: codecZstd, level: 0, levelSet: true}},
+		{name: "zstd level 19", c: compression{codec: codecZstd, level: 19, levelSet: true}},
+		{name: "xz default", c: compression{codec: codecXz}},
+		{name: "xz level 0", c: compression{codec: codecXz, level: 0, levelSet: true}},
+		{name: "lz4 default", c: compression{codec: codecLz4}},
+		{name: "lz4 level 0", c: compression{codec: codecLz4, level: 0, levelSet: true}},
+		{name: "lz4 level 9", c: compression{codec: codecLz4, level: 9, levelSet: true}},
+		{name: "lz4 invalid level", c: compression{codec: codecLz4, level: 10, levelSet: true}, wantErr: true},
+		{name: "none", c: compression{codec: codecNone}, stored: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := newCompressWriter(&buf, tt.c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newCompressWriter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if _, err := w.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if stored := buf.Len() >= len(data); stored != tt.stored {
+				t.Errorf("%d bytes compressed to %d, stored = %v, want %v", len(data), buf.Len(), stored, tt.stored)
+			}
+			r, _, err := newDecompressReader(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("decompressed %d bytes, they do not match the %d bytes written", len(got), len(data))
+			}
+		})
+	}
+}
@@ -11,7 +11,10 @@ import (
 	"github.com/jkaninda/volume-backup/utils"
 	"github.com/spf13/cobra"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type TgConfig struct {
@@ -19,24 +22,40 @@ type TgConfig struct {
 	ChatId string
 }
 type BackupConfig struct {
-	backupFileName     string
-	backupRetention    int
-	disableCompression bool
-	prune              bool
-	encryption         bool
-	remotePath         string
-	file               string
-	passphrase         string
-	storage            string
-	cronExpression     string
-	prefix             string
-	fromFolder         bool
+	backupFileName  string
+	backupRetention int
+	prune           bool
+	encryption      bool
+	remotePath      string
+	files           []string
+	encrypter       *encrypter
+	storages        []backupStorage
+	cronExpression  string
+	prefix          string
+	fromFolder      bool
+	consistent      bool
+	mode            string
+	format          string
+	compression     compression
+	filter          *pathFilter
+	snapshot        *snapshotIndex
+	// fullEvery is the interval of the full backups in incremental and differential modes
+	fullEvery fullInterval
+	// sourcePath is the backed up folder, the data path or a source folder
+	sourcePath string
+	// splitSize is the maximum size of the uploaded volumes, 0 to upload a single archive
+	splitSize int64
+	// source is the name of the backed up source, empty when the whole data path is backed up
+	source  string
+	sources []backupSource
+	// signer signs the stored archives
+	signer *signer
 }
 type FTPConfig struct {
 	host       string
 	user       string
 	password   string
-	port       string
+	port       int
 	remotePath string
 }
 
@@ -45,7 +64,7 @@ type SSHConfig struct {
 	user         string
 	password     string
 	hostName     string
-	port         string
+	port         int
 	identifyFile string
 }
 type AWSConfig struct {
@@ -56,7 +75,6 @@ type AWSConfig struct {
 	region         string
 	disableSsl     bool
 	forcePathStyle bool
-	remotePath     string
 }
 
 // loadSSHConfig loads the SSH configuration from environment variables
@@ -66,51 +84,81 @@ func loadSSHConfig() (*SSHConfig, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error missing environment variables: %w", err)
 	}
+	port, err := parsePort("SSH_PORT")
+	if err != nil {
+		return nil, err
+	}
+	password, err := utils.GetSecret("SSH_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
 
 	return &SSHConfig{
 		user:         os.Getenv("SSH_USER"),
-		password:     os.Getenv("SSH_PASSWORD"),
+		password:     password,
 		hostName:     os.Getenv("SSH_HOST"),
-		port:         os.Getenv("SSH_PORT"),
+		port:         port,
 		identifyFile: os.Getenv("SSH_IDENTIFY_FILE"),
 	}, nil
 }
-func initFtpConfig() *FTPConfig {
+
+// loadFTPConfig reads the FTP server configuration
+func loadFTPConfig() (*FTPConfig, error) {
+	err := utils.CheckEnvVars(ftpVars)
+	if err != nil {
+		return nil, err
+	}
+	port, err := parsePort("FTP_PORT")
+	if err != nil {
+		return nil, err
+	}
+	password, err := utils.GetSecret("FTP_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
 	//Initialize data configs
 	fConfig := FTPConfig{}
 	fConfig.host = os.Getenv("FTP_HOST")
 	fConfig.user = os.Getenv("FTP_USER")
-	fConfig.password = os.Getenv("FTP_PASSWORD")
-	fConfig.port = os.Getenv("FTP_PORT")
+	fConfig.password = password
+	fConfig.port = port
 	fConfig.remotePath = os.Getenv("REMOTE_PATH")
-	err := utils.CheckEnvVars(ftpVars)
-	if err != nil {
-		utils.Error("Please make sure all required environment variables for FTP are set")
-		utils.Fatal("Error missing environment variables: %s", err)
+	return &fConfig, nil
+}
+
+// parsePort parses the port number of an environment variable
+func parsePort(key string) (int, error) {
+	port, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid %s %q, it must be a port number", key, os.Getenv(key))
 	}
-	return &fConfig
+	return port, nil
 }
-func initAWSConfig() *AWSConfig {
+
+// loadAWSConfig reads the AWS S3 configuration, missing variables are returned as an error
+func loadAWSConfig() (*AWSConfig, error) {
+	err := utils.CheckEnvVars(awsVars)
+	if err != nil {
+		return nil, err
+	}
 	//Initialize data configs
 	aConfig := AWSConfig{}
 	aConfig.endpoint = os.Getenv("AWS_S3_ENDPOINT")
-	aConfig.accessKey = os.Getenv("AWS_ACCESS_KEY")
-	aConfig.secretKey = os.Getenv("AWS_SECRET_KEY")
+	if aConfig.accessKey, err = utils.GetSecret("AWS_ACCESS_KEY"); err != nil {
+		return nil, err
+	}
+	if aConfig.secretKey, err = utils.GetSecret("AWS_SECRET_KEY"); err != nil {
+		return nil, err
+	}
 	aConfig.bucket = os.Getenv("AWS_S3_BUCKET_NAME")
 	aConfig.region = os.Getenv("AWS_REGION")
-	aConfig.remotePath = os.Getenv("REMOTE_PATH")
 	disableSsl, err := strconv.ParseBool(os.Getenv("AWS_DISABLE_SSL"))
 	if err != nil {
-		utils.Fatal("Unable to parse AWS_DISABLE_SSL env var: %s", err)
+		return nil, fmt.Errorf("unable to parse AWS_DISABLE_SSL env var: %w", err)
 	}
 	aConfig.disableSsl = disableSsl
 	aConfig.forcePathStyle = true
-	err = utils.CheckEnvVars(awsVars)
-	if err != nil {
-		utils.Error("Please make sure all required environment variables for AWS S3 are set")
-		utils.Fatal("Error checking environment variables: %s", err)
-	}
-	return &aConfig
+	return &aConfig, nil
 }
 
 func initBackupConfig(cmd *cobra.Command) *BackupConfig {
@@ -120,46 +168,174 @@ func initBackupConfig(cmd *cobra.Command) *BackupConfig {
 	utils.GetEnv(cmd, "path", "REMOTE_PATH")
 	//Get flag value and set env
 	remotePath := utils.GetEnvVariable("REMOTE_PATH", "SSH_REMOTE_PATH")
+	// The storages of the configuration file are used when no storage is set with --storage or STORAGE
+	storageSet := cmd.Flags().Changed("storage") || os.Getenv("STORAGE") != ""
 	storage = utils.GetEnv(cmd, "storage", "STORAGE")
-	_, _ = cmd.Flags().GetString("mode")
-	passphrase := os.Getenv("GPG_PASSPHRASE")
+	mode := utils.GetEnv(cmd, "mode", "BACKUP_MODE")
+	fullEvery, err := parseFullInterval(utils.GetEnv(cmd, "full-every", "BACKUP_FULL_EVERY"))
+	if err != nil {
+		utils.Fatal("%v", err)
+	}
+	format := utils.GetEnv(cmd, "format", "BACKUP_FORMAT")
+	codec := utils.GetEnv(cmd, "compression", "BACKUP_COMPRESSION")
+	compressionLevel := utils.GetEnv(cmd, "compression-level", "BACKUP_COMPRESSION_LEVEL")
 	fromFolder := true
-	_ = utils.GetEnv(cmd, "path", "AWS_S3_PATH")
-	file = utils.GetEnv(cmd, "file", "FILE_NAME")
+	files := fileFlags(cmd)
 
 	cronExpression := os.Getenv("BACKUP_CRON_EXPRESSION")
+	consistent := utils.FlagGetBool(cmd, "consistent") || os.Getenv("BACKUP_CONSISTENT") == "true"
 	backupPrefix := os.Getenv("BACKUP_PREFIX")
 	if backupPrefix == "" {
 		encryption = true
 		backupPrefix = "backup"
 	}
-	if file != "" {
+	if len(files) > 0 {
 		fromFolder = false
 	}
+	switch mode {
+	case "":
+		mode = modeFull
+	case modeFull, modeIncremental, modeDifferential:
+	default:
+		utils.Fatal("Backup mode %s is not valid, supported modes are: full, incremental and differential", mode)
+	}
+	if !fromFolder && mode != modeFull {
+		utils.Warn("Backup mode %s is only supported for folder backups, using full mode", mode)
+		mode = modeFull
+	}
+	switch format {
+	case "":
+		format = formatArchive
+	case formatArchive:
+	case formatRepository:
+		if !fromFolder {
+			utils.Fatal("Repository format is only supported for folder backups")
+		}
+		if mode != modeFull {
+			utils.Warn("Backup mode %s is not used with the repository format, chunks are always deduplicated", mode)
+		}
+	default:
+		utils.Fatal("Backup format %s is not valid, supported formats are: archive and repository", format)
+	}
 
-	if passphrase != "" {
-		encryption = true
+	disableCompression := os.Getenv("BACKUP_DISABLE_COMPRESSION") == "true"
+	if codec == "" {
+		codec = codecGzip
+	}
+	if disableCompression {
+		codec = codecNone
+	}
+	if !validCodec(codec) {
+		utils.Fatal("Compression %s is not valid, supported codecs are: gzip, zstd, xz, lz4 and none", codec)
+	}
+	level, levelSet := 0, compressionLevel != ""
+	if levelSet {
+		var err error
+		level, err = strconv.Atoi(compressionLevel)
+		if err != nil || level < 0 {
+			utils.Fatal("Compression level %s is not valid", compressionLevel)
+		}
+	}
+	var splitSize int64
+	if value := utils.GetEnv(cmd, "split-size", "BACKUP_SPLIT_SIZE"); value != "" {
+		var err error
+		splitSize, err = utils.ParseSize(value)
+		if err != nil || splitSize <= 0 {
+			utils.Fatal("Split size %s is not valid", value)
+		}
+		if format == formatRepository {
+			utils.Warn("Split size is not used with the repository format, packs are already split")
+		}
+	}
+	configFile, err := readConfigFile(cmd)
+	if err != nil {
+		utils.Fatal("Error loading configuration: %v", err)
+	}
+	sourceFlags, _ := cmd.Flags().GetStringArray("source")
+	sources, err := loadSources(configFile, sourceFlags)
+	if err != nil {
+		utils.Fatal("Error loading sources: %v", err)
+	}
+	storages := parseStorages(storage)
+	if !storageSet && len(configFile.Storages) > 0 {
+		storages = configFile.Storages
+	}
+	if err := checkStorages(storages); err != nil {
+		utils.Fatal("Error loading storages: %v", err)
+	}
+	if len(sources) > 0 && !fromFolder {
+		utils.Fatal("Sources and files can not be backed up in the same job")
+	}
+	prune := utils.FlagGetBool(cmd, "prune") || os.Getenv("BACKUP_PRUNE") == "true"
+	retention := utils.GetIntEnv("BACKUP_RETENTION_DAYS")
+	if retention <= 0 {
+		retention = 7
+	}
+	var filter *pathFilter
+	if fromFolder {
+		includes, _ := cmd.Flags().GetStringArray("include")
+		excludes, _ := cmd.Flags().GetStringArray("exclude")
+		includes = append(includes, splitEnv("BACKUP_INCLUDE")...)
+		excludes = append(excludes, splitEnv("BACKUP_EXCLUDE")...)
+		filter, err = newPathFilter(includes, excludes, os.Getenv("EXCLUDE_FILE"))
+		if err != nil {
+			utils.Fatal("Error loading include and exclude patterns: %v", err)
+		}
 	}
 	//Initialize data configs
 	config := BackupConfig{}
-	config.storage = storage
+	config.storages = storages
 	config.prefix = backupPrefix
 	config.encryption = encryption
 	config.remotePath = remotePath
-	config.passphrase = passphrase
-	config.file = file
+	config.files = files
 	config.fromFolder = fromFolder
 	config.cronExpression = cronExpression
+	config.consistent = consistent
+	config.mode = mode
+	config.fullEvery = fullEvery
+	config.format = format
+	config.filter = filter
+	config.sourcePath = dataPath
+	config.sources = sources
+	config.splitSize = splitSize
+	config.prune = prune
+	config.backupRetention = retention
+	config.compression = compression{
+		codec:    codec,
+		level:    level,
+		levelSet: levelSet,
+		threads:  utils.GetIntEnv("BACKUP_COMPRESSION_THREADS"),
+	}
 	return &config
 }
 
 type RestoreConfig struct {
-	s3Path        string
-	remotePath    string
-	storage       string
-	file          string
-	bucket        string
-	gpqPassphrase string
+	remotePath string
+	storage    string
+	file       string
+	members    []string
+	source     string
+	// latest restores the latest backup, before the latest backup created before this time
+	latest bool
+	before time.Time
+	// prefix selects the backups of --latest and --before
+	prefix string
+	filter *pathFilter
+	// root is the directory the backup is restored to, the data path, a source folder or the --target directory
+	root     string
+	strategy string
+	// staging is the directory the backup is extracted to before being moved to the root
+	staging string
+	// removed collects the paths deleted by incremental backups, they are removed from the root by the merge strategy
+	removed map[string]bool
+	// dryRun compares the backup with the root without writing anything, the plan is printed as a table or as JSON
+	dryRun bool
+	output string
+	plan   *restorePlan
+	// allowUnsigned restores unsigned archives and archives not matching their signature, with a warning
+	allowUnsigned bool
+	verifier      *signatureVerifier
 }
 
 func initRestoreConfig(cmd *cobra.Command) *RestoreConfig {
@@ -167,21 +343,290 @@ func initRestoreConfig(cmd *cobra.Command) *RestoreConfig {
 	utils.GetEnv(cmd, "path", "REMOTE_PATH")
 
 	//Get flag value and set env
-	s3Path := utils.GetEnv(cmd, "path", "AWS_S3_PATH")
 	remotePath := utils.GetEnvVariable("REMOTE_PATH", "SSH_REMOTE_PATH")
 	storage = utils.GetEnv(cmd, "storage", "STORAGE")
-	file = utils.GetEnv(cmd, "file", "FILE_NAME")
-	_, _ = cmd.Flags().GetString("mode")
-	bucket := utils.GetEnvVariable("AWS_S3_BUCKET_NAME", "BUCKET_NAME")
-	gpqPassphrase := os.Getenv("GPG_PASSPHRASE")
+	latest := utils.FlagGetBool(cmd, "latest") || os.Getenv("RESTORE_LATEST") == "true"
+	var before time.Time
+	if value := utils.GetEnv(cmd, "before", "RESTORE_BEFORE"); value != "" {
+		t, err := parseRestoreTime(value)
+		if err != nil {
+			utils.Fatal("Invalid --before time %s, expected eg: 2024-10-01 12:00", value)
+		}
+		before = t
+	}
+	if latest && !before.IsZero() {
+		utils.Fatal("Error, --latest cannot be used with --before")
+	}
+	// With --latest or --before, the backup is resolved from the storage
+	if !latest && before.IsZero() {
+		file = utils.GetEnv(cmd, "file", "FILE_NAME")
+	} else if cmd.Flags().Changed("file") {
+		utils.Fatal("Error, --file cannot be used with --latest or --before")
+	}
+	var members []string
+	names, _ := cmd.Flags().GetStringArray("member")
+	if len(names) == 0 {
+		names = splitEnv("RESTORE_MEMBERS")
+	}
+	for _, name := range names {
+		member, ok := memberPath(name)
+		if !ok {
+			utils.Fatal("Member %s is not inside %s", name, dataPath)
+		}
+		members = append(members, member)
+	}
+	var filter *pathFilter
+	includes, _ := cmd.Flags().GetStringArray("include")
+	excludes, _ := cmd.Flags().GetStringArray("exclude")
+	includes = append(includes, splitEnv("RESTORE_INCLUDE")...)
+	excludes = append(excludes, splitEnv("RESTORE_EXCLUDE")...)
+	if len(includes) > 0 || len(excludes) > 0 {
+		var err error
+		filter, err = newPathFilter(includes, excludes, "")
+		if err != nil {
+			utils.Fatal("Error loading include and exclude patterns: %v", err)
+		}
+	}
+	root := dataPath
+	prefix := os.Getenv("BACKUP_PREFIX")
+	sourceName := utils.GetEnv(cmd, "source", "RESTORE_SOURCE")
+	if sourceName != "" {
+		source := resolveSource(cmd, sourceName)
+		prefix = source.Prefix
+		root = filepath.Join(dataPath, source.Path)
+		utils.Info("Restoring source %s to %s", source.Name, root)
+	}
+	if target := utils.GetEnv(cmd, "target", "RESTORE_TARGET"); target != "" {
+		root = filepath.Clean(target)
+	}
+	if err := checkRestoreTarget(root); err != nil {
+		utils.Fatal("Invalid restore target: %v", err)
+	}
+	strategy := utils.GetEnv(cmd, "strategy", "RESTORE_STRATEGY")
+	if strategy == "" {
+		strategy = strategyMerge
+	}
+	if !isValidStrategy(strategy) {
+		utils.Fatal("Invalid restore strategy %s, merge, clean, skip-existing or fail-if-not-empty", strategy)
+	}
+	dryRun := utils.FlagGetBool(cmd, "dry-run") || os.Getenv("RESTORE_DRY_RUN") == "true"
+	output := utils.GetEnv(cmd, "output", "RESTORE_OUTPUT")
+	if output != "" && output != "table" && output != "json" {
+		utils.Fatal("Invalid output %s, table or json", output)
+	}
+	if output == "json" && dryRun {
+		// The plan is the only content of the standard output
+		utils.SetLogOutput(os.Stderr)
+	}
 	//Initialize restore configs
 	rConfig := RestoreConfig{}
-	rConfig.s3Path = s3Path
 	rConfig.remotePath = remotePath
 	rConfig.storage = storage
-	rConfig.bucket = bucket
 	rConfig.file = file
-	rConfig.storage = storage
-	rConfig.gpqPassphrase = gpqPassphrase
+	rConfig.members = members
+	rConfig.filter = filter
+	rConfig.latest = latest
+	rConfig.before = before
+	rConfig.prefix = prefix
+	rConfig.source = sourceName
+	rConfig.root = root
+	rConfig.strategy = strategy
+	rConfig.removed = make(map[string]bool)
+	rConfig.dryRun = dryRun
+	rConfig.output = output
+	rConfig.allowUnsigned = utils.FlagGetBool(cmd, "allow-unsigned") || os.Getenv("RESTORE_ALLOW_UNSIGNED") == "true"
 	return &rConfig
 }
+
+type VerifyConfig struct {
+	storage        string
+	remotePath     string
+	file           string
+	source         string
+	prefix         string
+	latest         bool
+	all            bool
+	cronExpression string
+	allowUnsigned  bool
+}
+
+func initVerifyConfig(cmd *cobra.Command) *VerifyConfig {
+	utils.GetEnv(cmd, "path", "REMOTE_PATH")
+	conf := VerifyConfig{}
+	conf.storage = utils.GetEnv(cmd, "storage", "STORAGE")
+	conf.remotePath = utils.GetEnvVariable("REMOTE_PATH", "SSH_REMOTE_PATH")
+	conf.file = utils.GetEnv(cmd, "file", "FILE_NAME")
+	conf.source = utils.GetEnv(cmd, "source", "VERIFY_SOURCE")
+	conf.prefix = os.Getenv("BACKUP_PREFIX")
+	if conf.source != "" {
+		// Backups of a source are named after its prefix
+		conf.prefix = resolveSource(cmd, conf.source).Prefix
+	}
+	conf.latest = utils.FlagGetBool(cmd, "latest") || os.Getenv("VERIFY_LATEST") == "true"
+	conf.all = utils.FlagGetBool(cmd, "all") || os.Getenv("VERIFY_ALL") == "true"
+	conf.cronExpression = utils.GetEnv(cmd, "cron-expression", "VERIFY_CRON_EXPRESSION")
+	conf.allowUnsigned = utils.FlagGetBool(cmd, "allow-unsigned") || os.Getenv("VERIFY_ALLOW_UNSIGNED") == "true"
+	if conf.file == "" && !conf.latest && !conf.all {
+		utils.Fatal("Error, file required, or --latest or --all")
+	}
+	if conf.file != "" && (conf.latest || conf.all) {
+		utils.Fatal("Error, --file cannot be used with --latest or --all")
+	}
+	return &conf
+}
+
+type RekeyConfig struct {
+	storage    string
+	remotePath string
+	file       string
+	source     string
+	prefix     string
+	all        bool
+	// encrypter encrypts the files with the new keys, the old keys are the restore keys
+	encrypter *encrypter
+	// signer signs the rekeyed files, the signature of the stored bytes changes with the keys
+	signer *signer
+}
+
+func initRekeyConfig(cmd *cobra.Command) *RekeyConfig {
+	utils.GetEnv(cmd, "path", "REMOTE_PATH")
+	conf := RekeyConfig{}
+	conf.storage = utils.GetEnv(cmd, "storage", "STORAGE")
+	conf.remotePath = utils.GetEnvVariable("REMOTE_PATH", "SSH_REMOTE_PATH")
+	conf.file = utils.GetEnv(cmd, "file", "FILE_NAME")
+	conf.source = utils.GetEnv(cmd, "source", "REKEY_SOURCE")
+	conf.prefix = os.Getenv("BACKUP_PREFIX")
+	if conf.source != "" {
+		// Backups of a source are named after its prefix
+		conf.prefix = resolveSource(cmd, conf.source).Prefix
+	}
+	conf.all = utils.FlagGetBool(cmd, "all") || os.Getenv("REKEY_ALL") == "true"
+	if conf.file == "" && !conf.all {
+		utils.Fatal("Error, file required, or --all")
+	}
+	if conf.file != "" && conf.all {
+		utils.Fatal("Error, --file cannot be used with --all")
+	}
+	passphrase, err := utils.GetSecretBytes("NEW_GPG_PASSPHRASE")
+	if err != nil {
+		utils.Fatal("Error loading the new encryption keys: %v", err)
+	}
+	enc, err := newEncrypter(passphrase, splitEnv("NEW_GPG_PUBLIC_KEY_FILE"), splitEnv("NEW_AGE_RECIPIENTS"))
+	if err != nil {
+		utils.Fatal("Error loading the new encryption keys: %v", err)
+	}
+	if enc == nil {
+		utils.Fatal("NEW_GPG_PASSPHRASE, NEW_GPG_PUBLIC_KEY_FILE or NEW_AGE_RECIPIENTS environment variable is required")
+	}
+	conf.encrypter = enc
+	conf.signer = loadSigner()
+	return &conf
+}
+
+type ListConfig struct {
+	storage    string
+	remotePath string
+	source     string
+	prefix     string
+	output     string
+}
+
+func initListConfig(cmd *cobra.Command) *ListConfig {
+	utils.GetEnv(cmd, "path", "REMOTE_PATH")
+	conf := ListConfig{}
+	conf.storage = utils.GetEnv(cmd, "storage", "STORAGE")
+	conf.remotePath = utils.GetEnvVariable("REMOTE_PATH", "SSH_REMOTE_PATH")
+	conf.source = utils.GetEnv(cmd, "source", "LIST_SOURCE")
+	conf.prefix = os.Getenv("BACKUP_PREFIX")
+	if conf.source != "" {
+		// Backups of a source are named after its prefix
+		conf.prefix = resolveSource(cmd, conf.source).Prefix
+	}
+	conf.output = utils.GetEnv(cmd, "output", "LIST_OUTPUT")
+	if conf.output != "" && conf.output != "table" && conf.output != "json" {
+		utils.Fatal("Invalid output %s, table or json", conf.output)
+	}
+	return &conf
+}
+
+// splitEnv returns the comma separated values of an environment variable
+func splitEnv(envName string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(envName), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// fileFlags returns the values of the repeatable --file flag, or the comma separated FILE_NAME environment variable
+func fileFlags(cmd *cobra.Command) []string {
+	files, _ := cmd.Flags().GetStringArray("file")
+	if len(files) > 0 {
+		utils.SetEnv("FILE_NAME", strings.Join(files, ","))
+		return files
+	}
+	return splitEnv("FILE_NAME")
+}
+
+// loadEncrypter reads the encryption keys of the backups, the passphrase is read again for every backup run
+func loadEncrypter() *encrypter {
+	passphrase, err := utils.GetSecretBytes("GPG_PASSPHRASE")
+	if err != nil {
+		utils.Fatal("Error loading encryption keys: %v", err)
+	}
+	enc, err := newEncrypter(passphrase, splitEnv("GPG_PUBLIC_KEY_FILE"), splitEnv("AGE_RECIPIENTS"))
+	if err != nil {
+		utils.Fatal("Error loading encryption keys: %v", err)
+	}
+	return enc
+}
+
+// loadSigner reads the signing key of the backups, the HMAC key is read again for every backup run
+func loadSigner() *signer {
+	keyPassphrase, err := utils.GetSecretBytes("SIGNING_KEY_PASSPHRASE")
+	if err != nil {
+		utils.Fatal("Error loading signing key: %v", err)
+	}
+	hmacKey, err := utils.GetSecretBytes("SIGNING_HMAC_KEY")
+	if err != nil {
+		clear(keyPassphrase)
+		utils.Fatal("Error loading signing key: %v", err)
+	}
+	s, err := newSigner(os.Getenv("SIGNING_KEY_FILE"), keyPassphrase, hmacKey)
+	if err != nil {
+		utils.Fatal("Error loading signing key: %v", err)
+	}
+	return s
+}
+
+// archiveName returns the name of the backup archive, with the .gpg or .age extension when it is encrypted
+func (config *BackupConfig) archiveName() string {
+	return config.encrypter.fileName(config.backupFileName)
+}
+
+// parseRestoreTime parses a --before time in the local time zone, like the backup names
+func parseRestoreTime(value string) (time.Time, error) {
+	var err error
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02", time.RFC3339, "20060102_150405"} {
+		var t time.Time
+		if t, err = time.ParseInLocation(layout, strings.TrimSpace(value), time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// options returns the restore options of the configuration
+// The backup is extracted to the staging directory once it is created.
+func (conf *RestoreConfig) options() restoreOptions {
+	opts := restoreOptions{root: conf.root, members: conf.members, filter: conf.filter, plan: conf.plan, verifier: conf.verifier}
+	if conf.staging != "" {
+		opts.root = conf.staging
+		opts.target = conf.root
+		opts.overlay = conf.strategy != strategyClean
+		opts.removed = conf.removed
+	}
+	return opts
+}
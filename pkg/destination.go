@@ -0,0 +1,195 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jkaninda/volume-backup/utils"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupStorage is a storage the backups are uploaded to, set with --storage or in the configuration file
+type backupStorage struct {
+	Type string `yaml:"type"`
+	// RetentionDays overrides BACKUP_RETENTION_DAYS and the retention of the sources on this storage
+	RetentionDays int `yaml:"retentionDays"`
+}
+
+// parseStorages parses a comma separated --storage value, eg: local,s3,ssh
+func parseStorages(value string) []backupStorage {
+	var storages []backupStorage
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			storages = append(storages, backupStorage{Type: name})
+		}
+	}
+	return storages
+}
+
+// checkStorages checks the storage types, a storage can only be set once
+func checkStorages(storages []backupStorage) error {
+	if len(storages) == 0 {
+		return errors.New("no storage set")
+	}
+	types := make(map[string]bool)
+	for _, s := range storages {
+		if _, err := lookupBackend(s.Type); err != nil {
+			return err
+		}
+		if types[s.Type] {
+			return fmt.Errorf("duplicate storage %s", s.Type)
+		}
+		types[s.Type] = true
+	}
+	return nil
+}
+
+// storagesName returns the storage types, eg: local, s3
+func storagesName(storages []backupStorage) string {
+	names := make([]string, 0, len(storages))
+	for _, s := range storages {
+		names = append(names, s.Type)
+	}
+	return strings.Join(names, ", ")
+}
+
+// destination is a storage a backup is uploaded to, err is set once an upload to it failed
+type destination struct {
+	storage   string
+	backend   backend
+	retention int
+	err       error
+	// file and size are the uploaded backup, reported once the upload is done
+	file string
+	size int64
+}
+
+// destinations uploads the files of a backup to every storage in parallel. A storage is skipped once an upload to it
+// failed, the backup is still uploaded to the others.
+type destinations []*destination
+
+// openDestinations creates the backends of the backup storages, a storage that cannot be created is reported as failed
+func openDestinations(config *BackupConfig) destinations {
+	var dests destinations
+	for _, s := range config.storages {
+		d := &destination{storage: s.Type, retention: config.backupRetention}
+		if s.RetentionDays > 0 {
+			d.retention = s.RetentionDays
+		}
+		b, err := newBackend(s.Type, config.remotePath, config.source)
+		if err != nil {
+			utils.Error("Error creating %s storage: %v", s.Type, err)
+			err = fmt.Errorf("error creating storage: %w", err)
+		}
+		d.backend, d.err = b, err
+		dests = append(dests, d)
+	}
+	// Sources are stored in their own directory, created on the first backup
+	if config.source != "" {
+		_ = dests.each(func(d *destination) error {
+			if err := d.backend.MakeDir(); err != nil {
+				return fmt.Errorf("error creating storage directory: %w", err)
+			}
+			return nil
+		})
+	}
+	return dests
+}
+
+// active returns the storages no upload failed to
+func (dests destinations) active() destinations {
+	var active destinations
+	for _, d := range dests {
+		if d.err == nil {
+			active = append(active, d)
+		}
+	}
+	return active
+}
+
+// each runs fn for every active storage in parallel, a storage fn fails for is skipped afterwards.
+// It returns an error once every storage failed.
+func (dests destinations) each(fn func(d *destination) error) error {
+	var wg sync.WaitGroup
+	for _, d := range dests.active() {
+		wg.Add(1)
+		go func(d *destination) {
+			defer wg.Done()
+			if err := fn(d); err != nil {
+				d.err = err
+				utils.Error("Error uploading backup to %s storage: %v", d.storage, err)
+			}
+		}(d)
+	}
+	wg.Wait()
+	if len(dests.active()) == 0 {
+		return errors.New("the backup could not be uploaded to any storage")
+	}
+	return nil
+}
+
+// Put uploads a file of the temp directory to every active storage
+func (dests destinations) Put(name string) error {
+	return dests.each(func(d *destination) error {
+		if err := d.backend.Put(name); err != nil {
+			return fmt.Errorf("error uploading %s: %w", name, err)
+		}
+		return nil
+	})
+}
+
+// fail marks every active storage as failed, the backup could not be created
+func (dests destinations) fail(err error) {
+	for _, d := range dests.active() {
+		d.err = err
+	}
+}
+
+// prune deletes the old backups of each storage with its retention, a pruning error does not fail the backup
+func (dests destinations) prune() {
+	var wg sync.WaitGroup
+	for _, d := range dests.active() {
+		wg.Add(1)
+		go func(d *destination) {
+			defer wg.Done()
+			if err := pruneBackend(d.backend, d.retention); err != nil {
+				utils.Error("Error pruning old backups of %s storage, error %v", d.storage, err)
+			}
+		}(d)
+	}
+	wg.Wait()
+}
+
+// report logs and notifies the result of each storage, it returns an error if the backup is missing from a storage
+func (dests destinations) report(config *BackupConfig, startTime string) error {
+	failed := 0
+	for _, d := range dests {
+		if d.err != nil {
+			failed++
+			utils.Error("Backup to %s storage failed: %v", d.storage, d.err)
+			utils.NotifyError(fmt.Sprintf("Backup to %s storage failed: %v", d.storage, d.err))
+			continue
+		}
+		utils.Info("Backup uploaded to %s storage: %s", d.storage, d.backend.Location(d.file))
+		utils.NotifySuccess(&utils.NotificationData{
+			File:           d.file,
+			BackupSize:     d.size,
+			Storage:        d.storage,
+			BackupLocation: d.backend.Location(d.file),
+			Source:         config.source,
+			StartTime:      startTime,
+			EndTime:        time.Now().Format(utils.TimeFormat()),
+		})
+	}
+	if failed > 0 {
+		return fmt.Errorf("backup failed on %d of %d storage(s)", failed, len(dests))
+	}
+	return nil
+}
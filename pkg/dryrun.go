@@ -0,0 +1,420 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/jkaninda/volume-backup/utils"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Dry-run actions, what a restore would do to a path of the target
+const (
+	actionCreate    = "create"
+	actionOverwrite = "overwrite"
+	actionUnchanged = "unchanged"
+	// actionSkip is an existing file differing from the backup, kept by the skip-existing strategy
+	actionSkip = "skip"
+	// actionDelete is a path removed by the clean strategy or by an incremental backup
+	actionDelete = "delete"
+	// actionKeep is a path of the target which is not in the backup
+	actionKeep = "keep"
+)
+
+// plannedFile describes a file of the backup or of the target
+type plannedFile struct {
+	Type    string    `json:"type"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Mode    string    `json:"mode"`
+	SHA256  string    `json:"sha256,omitempty"`
+	Link    string    `json:"link,omitempty"`
+}
+
+// plannedEntry is what a restore would do to a path, compared to the existing file of the target
+type plannedEntry struct {
+	Path   string       `json:"path"`
+	Action string       `json:"action"`
+	Backup *plannedFile `json:"backup,omitempty"`
+	// Current is the existing file of the target, nil when it does not exist
+	Current *plannedFile `json:"current,omitempty"`
+	// Changes lists what differs from the existing file: type, size, mtime, mode, content or link
+	Changes []string `json:"changes,omitempty"`
+}
+
+// restorePlan collects the entries of a dry-run restore, nothing is written to the target
+type restorePlan struct {
+	target   string
+	strategy string
+	entries  map[string]*plannedEntry
+}
+
+func newRestorePlan(target, strategy string) *restorePlan {
+	return &restorePlan{target: target, strategy: strategy, entries: make(map[string]*plannedEntry)}
+}
+
+// add compares an entry of the backup with the existing file it would be restored to.
+// sameContent reports whether an existing regular file has the content of the entry, with the SHA-256 of the file when it is computed.
+func (p *restorePlan) add(header *tar.Header, outputPath, sum string, sameContent func(string) (string, bool, error)) error {
+	name := path.Clean(strings.TrimPrefix(filepath.ToSlash(header.Name), "./"))
+	entry := &plannedEntry{Path: name, Backup: &plannedFile{
+		Type:    entryType(header.Typeflag),
+		Size:    header.Size,
+		ModTime: header.ModTime,
+		Mode:    fmt.Sprintf("%04o", header.FileInfo().Mode().Perm()),
+		SHA256:  sum,
+		Link:    header.Linkname,
+	}}
+	p.entries[name] = entry
+	// A restored path cancels the deletion of its parent directories
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if parent, ok := p.entries[dir]; ok && parent.Action == actionDelete {
+			delete(p.entries, dir)
+		}
+	}
+	info, err := os.Lstat(outputPath)
+	if os.IsNotExist(err) {
+		entry.Action = actionCreate
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	entry.Current = currentFile(outputPath, info)
+	backupType := entry.Backup.Type
+	if backupType == "hardlink" {
+		backupType = "file"
+	}
+	if backupType != entry.Current.Type {
+		entry.Changes = append(entry.Changes, "type")
+	} else {
+		if backupType == "file" && entry.Backup.Size != entry.Current.Size && header.Typeflag != tar.TypeLink {
+			entry.Changes = append(entry.Changes, "size")
+		}
+		if backupType != "dir" && entry.Backup.ModTime.Unix() != entry.Current.ModTime.Unix() {
+			entry.Changes = append(entry.Changes, "mtime")
+		}
+		// Existing directories keep their permissions, unless the target is emptied
+		if backupType != "symlink" && entry.Backup.Mode != entry.Current.Mode && (backupType != "dir" || p.strategy == strategyClean) {
+			entry.Changes = append(entry.Changes, "mode")
+		}
+		if backupType == "symlink" && entry.Backup.Link != entry.Current.Link {
+			entry.Changes = append(entry.Changes, "link")
+		}
+		if backupType == "file" {
+			digest, same, err := sameContent(outputPath)
+			if err != nil {
+				return err
+			}
+			entry.Current.SHA256 = digest
+			if !same {
+				entry.Changes = append(entry.Changes, "content")
+			}
+		}
+	}
+	switch {
+	case len(entry.Changes) == 0:
+		entry.Action = actionUnchanged
+	case p.strategy == strategySkipExisting:
+		entry.Action = actionSkip
+	default:
+		entry.Action = actionOverwrite
+	}
+	return nil
+}
+
+// drop removes an entry of the backup from the plan, it is rejected and is not restored
+func (p *restorePlan) drop(name string) {
+	delete(p.entries, path.Clean(strings.TrimPrefix(filepath.ToSlash(name), "./")))
+}
+
+// remove records a path deleted by an incremental backup, the merge strategy removes it from the target
+func (p *restorePlan) remove(name, outputPath string) {
+	name = path.Clean(name)
+	for entryPath := range p.entries {
+		if entryPath == name || strings.HasPrefix(entryPath, name+"/") {
+			delete(p.entries, entryPath)
+		}
+	}
+	if p.strategy != strategyMerge {
+		return
+	}
+	if info, err := os.Lstat(outputPath); err == nil {
+		p.entries[name] = &plannedEntry{Path: name, Action: actionDelete, Current: currentFile(outputPath, info)}
+	}
+}
+
+// deleted reports whether a path or one of its parent directories is deleted
+func (p *restorePlan) deleted(name string) bool {
+	for ; name != "."; name = path.Dir(name) {
+		if entry, ok := p.entries[name]; ok && entry.Action == actionDelete {
+			return true
+		}
+	}
+	return false
+}
+
+// finish adds the paths of the target which are not in the backup, they are kept or deleted by the clean strategy
+func (p *restorePlan) finish() error {
+	if _, err := os.Lstat(p.target); os.IsNotExist(err) {
+		return nil
+	}
+	return filepath.WalkDir(p.target, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if filePath == p.target {
+			return nil
+		}
+		if isRestoreDir(d.Name()) && filepath.Dir(filePath) == p.target {
+			return fs.SkipDir
+		}
+		rel, _ := filepath.Rel(p.target, filePath)
+		name := filepath.ToSlash(rel)
+		if _, ok := p.entries[name]; ok {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		action := actionKeep
+		if p.strategy == strategyClean || p.deleted(name) {
+			action = actionDelete
+		}
+		p.entries[name] = &plannedEntry{Path: name, Action: action, Current: currentFile(filePath, info)}
+		return nil
+	})
+}
+
+// sorted returns the planned entries sorted by path
+func (p *restorePlan) sorted() []*plannedEntry {
+	entries := make([]*plannedEntry, 0, len(p.entries))
+	for _, entry := range p.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+	return entries
+}
+
+// print writes the plan to the standard output, as a table or as JSON
+func (p *restorePlan) print(output string) error {
+	entries := p.sorted()
+	if output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(struct {
+			Target   string          `json:"target"`
+			Strategy string          `json:"strategy"`
+			Entries  []*plannedEntry `json:"entries"`
+		}{p.target, p.strategy, entries})
+	}
+	counts := make(map[string]int)
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "ACTION\tPATH\tCHANGES")
+	for _, entry := range entries {
+		counts[entry.Action]++
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", entry.Action, entry.Path, entry.describe())
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("\nRestore to %s, strategy %s: %d to create, %d to overwrite, %d to delete, %d unchanged, %d skipped, %d kept\n",
+		p.target, p.strategy, counts[actionCreate], counts[actionOverwrite], counts[actionDelete], counts[actionUnchanged], counts[actionSkip], counts[actionKeep])
+	return nil
+}
+
+// describe returns the differences between the backup and the existing file
+func (e *plannedEntry) describe() string {
+	var details []string
+	for _, change := range e.Changes {
+		switch change {
+		case "type":
+			details = append(details, fmt.Sprintf("type %s -> %s", e.Current.Type, e.Backup.Type))
+		case "size":
+			details = append(details, fmt.Sprintf("size %s -> %s", utils.FormatSize(e.Current.Size), utils.FormatSize(e.Backup.Size)))
+		case "mtime":
+			details = append(details, fmt.Sprintf("mtime %s -> %s", e.Current.ModTime.Format("2006-01-02 15:04:05"), e.Backup.ModTime.Format("2006-01-02 15:04:05")))
+		case "mode":
+			details = append(details, fmt.Sprintf("mode %s -> %s", e.Current.Mode, e.Backup.Mode))
+		case "link":
+			details = append(details, fmt.Sprintf("link %s -> %s", e.Current.Link, e.Backup.Link))
+		case "content":
+			details = append(details, "content")
+		}
+	}
+	if len(details) == 0 {
+		return "-"
+	}
+	return strings.Join(details, ", ")
+}
+
+// currentFile describes an existing file of the target
+func currentFile(filePath string, info os.FileInfo) *plannedFile {
+	file := &plannedFile{
+		Type:    fileType(info.Mode()),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Mode:    fmt.Sprintf("%04o", info.Mode().Perm()),
+	}
+	if file.Type != "file" {
+		file.Size = 0
+	}
+	if file.Type == "symlink" {
+		file.Link, _ = os.Readlink(filePath)
+	}
+	return file
+}
+
+// fileType returns the manifest type of a file mode
+func fileType(mode os.FileMode) string {
+	switch {
+	case mode.IsRegular():
+		return "file"
+	case mode.IsDir():
+		return "dir"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	case mode&os.ModeDevice != 0:
+		return "device"
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	default:
+		return "other"
+	}
+}
+
+// fileSHA256 returns the SHA-256 of the content of a file
+func fileSHA256(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// planEntry adds a tar entry to the dry-run plan, entries are checked like extracted ones but nothing is written
+func (e *extractor) planEntry(tarReader *tar.Reader, header *tar.Header, outputPath string) error {
+	var sum string
+	sameContent := func(string) (string, bool, error) { return "", true, nil }
+	switch header.Typeflag {
+	case tar.TypeDir, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+	case tar.TypeReg:
+		ok, err := e.checkSize(header.Name, header.Size)
+		if err != nil || !ok {
+			return err
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, tarReader); err != nil {
+			return err
+		}
+		sum = hex.EncodeToString(h.Sum(nil))
+		if !e.checkSum(header.Name, outputPath, sum) {
+			return nil
+		}
+		sameContent = func(filePath string) (string, bool, error) {
+			digest, err := fileSHA256(filePath)
+			return digest, digest == sum, err
+		}
+	case tar.TypeSymlink:
+		if err := e.checkSymlink(outputPath, header.Linkname); err != nil {
+			e.reject(header.Name, err.Error())
+			return nil
+		}
+	case tar.TypeLink:
+		target, err := e.safePath(header.Linkname)
+		if err != nil {
+			e.reject(header.Name, fmt.Sprintf("hard link target: %v", err))
+			return nil
+		}
+		// An existing hard link is unchanged when it is already a link to the target
+		sameContent = func(filePath string) (string, bool, error) {
+			current, err := os.Lstat(filePath)
+			if err != nil {
+				return "", false, err
+			}
+			linked, err := os.Lstat(target)
+			return "", err == nil && os.SameFile(current, linked), nil
+		}
+	default:
+		e.reject(header.Name, fmt.Sprintf("unsupported file type %c", header.Typeflag))
+		return nil
+	}
+	e.restored++
+	return e.plan.add(header, outputPath, sum, sameContent)
+}
+
+// planNode adds a repository node to the dry-run plan, the content of existing files is compared chunk by chunk
+func (e *extractor) planNode(node repositoryNode, outputPath string) error {
+	switch node.Type {
+	case "dir":
+	case "symlink":
+		if err := e.checkSymlink(outputPath, node.Linkname); err != nil {
+			e.reject(node.Path, err.Error())
+			return nil
+		}
+	case "file":
+		ok, err := e.checkSize(node.Path, node.Size)
+		if err != nil || !ok {
+			return err
+		}
+	case "hardlink", "char", "block", "fifo":
+		return e.planEntry(nil, node.header(), outputPath)
+	default:
+		e.reject(node.Path, fmt.Sprintf("unsupported node type %s", node.Type))
+		return nil
+	}
+	header := node.header()
+	header.Size = node.Size
+	e.restored++
+	return e.plan.add(header, outputPath, "", func(filePath string) (string, bool, error) {
+		same, err := sameChunks(filePath, node.Chunks)
+		return "", same, err
+	})
+}
+
+// sameChunks reports whether a file is made of the given chunks
+func sameChunks(filePath string, chunks []string) (bool, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	c := newChunker(file)
+	for i := 0; ; i++ {
+		data, err := c.Next()
+		if err == io.EOF {
+			return i == len(chunks), nil
+		}
+		if err != nil {
+			return false, err
+		}
+		sum := sha256.Sum256(data)
+		if i >= len(chunks) || chunks[i] != hex.EncodeToString(sum[:]) {
+			return false, nil
+		}
+	}
+}
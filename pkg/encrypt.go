@@ -0,0 +1,361 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"filippo.io/age"
+	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgpErrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/jkaninda/volume-backup/utils"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Encryption modes, recorded in the backup manifests
+const (
+	encryptionNone = "none"
+	// encryptionGPG is OpenPGP symmetric encryption with a passphrase
+	encryptionGPG = "gpg"
+	// encryptionGPGPublicKey is OpenPGP encryption to public keys
+	encryptionGPGPublicKey = "gpg-public-key"
+	// encryptionAge is age encryption to X25519 recipients
+	encryptionAge = "age"
+)
+
+// encrypter encrypts backups with a passphrase, OpenPGP public keys or age recipients.
+// A nil encrypter does not encrypt.
+type encrypter struct {
+	mode       string
+	passphrase []byte
+	keys       openpgp.EntityList
+	recipients []age.Recipient
+}
+
+// newEncrypter creates the encrypter of the backups, it returns nil when no passphrase, key file or recipient is set.
+// A passphrase, public keys and age recipients cannot be combined. The encrypter owns the passphrase, it is cleared by wipe.
+func newEncrypter(passphrase []byte, keyFiles, recipients []string) (*encrypter, error) {
+	used := 0
+	for _, set := range []bool{len(passphrase) > 0, len(keyFiles) > 0, len(recipients) > 0} {
+		if set {
+			used++
+		}
+	}
+	if used != 1 {
+		clear(passphrase)
+	}
+	if used == 0 {
+		return nil, nil
+	}
+	if used > 1 {
+		return nil, errors.New("a passphrase, public keys and age recipients cannot be combined")
+	}
+	e := &encrypter{mode: encryptionGPG, passphrase: passphrase}
+	for _, keyFile := range keyFiles {
+		keys, err := readKeyRing(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading public key %s: %w", keyFile, err)
+		}
+		for _, key := range keys {
+			if _, ok := key.EncryptionKey(time.Now()); !ok {
+				return nil, fmt.Errorf("key %s of %s cannot be used for encryption", key.PrimaryKey.KeyIdString(), keyFile)
+			}
+		}
+		e.mode = encryptionGPGPublicKey
+		e.keys = append(e.keys, keys...)
+	}
+	for _, recipient := range recipients {
+		r, err := age.ParseX25519Recipient(recipient)
+		if err != nil {
+			return nil, fmt.Errorf("invalid age recipient %s: %w", recipient, err)
+		}
+		e.mode = encryptionAge
+		e.recipients = append(e.recipients, r)
+	}
+	return e, nil
+}
+
+// wipe clears the passphrases of the encrypter from memory, it cannot be used anymore
+func (e *encrypter) wipe() {
+	if e == nil {
+		return
+	}
+	clear(e.passphrase)
+}
+
+// extension returns the extension of the encrypted files, age or gpg
+func (e *encrypter) extension() string {
+	if e.mode == encryptionAge {
+		return ageExtension
+	}
+	return gpgExtension
+}
+
+// fileName returns the name of a file once encrypted, names are unchanged without encryption
+func (e *encrypter) fileName(name string) string {
+	if e == nil {
+		return name
+	}
+	return fmt.Sprintf("%s.%s", name, e.extension())
+}
+
+// manifestMode returns the encryption recorded in the backup manifests
+func (e *encrypter) manifestMode() string {
+	if e == nil {
+		return encryptionNone
+	}
+	return e.mode
+}
+
+// canDecrypt reports whether the encrypted files can be read back by the backup, without a private key
+func (e *encrypter) canDecrypt() bool {
+	return e == nil || e.mode == encryptionGPG
+}
+
+// writer encrypts what is written to w, the message is completed on Close.
+// Archives are already compressed, the message is not compressed again.
+func (e *encrypter) writer(w io.Writer) (io.WriteCloser, error) {
+	hints := &openpgp.FileHints{IsBinary: true}
+	config := &packet.Config{DefaultCipher: packet.CipherAES256}
+	switch e.mode {
+	case encryptionGPGPublicKey:
+		return openpgp.Encrypt(w, e.keys, nil, hints, config)
+	case encryptionAge:
+		return age.Encrypt(w, e.recipients...)
+	}
+	return openpgp.SymmetricallyEncrypt(w, e.passphrase, hints, config)
+}
+
+// readKeyRing reads the OpenPGP keys of an armored or binary key file
+func readKeyRing(name string) (openpgp.EntityList, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		return openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(data))
+}
+
+// encryptedFile is a file written through an encryption stage
+type encryptedFile struct {
+	io.WriteCloser
+	file   *os.File
+	closed bool
+}
+
+// Close completes the encrypted message and closes the file, it can be called several times
+func (f *encryptedFile) Close() error {
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	if err := f.WriteCloser.Close(); err != nil {
+		_ = f.file.Close()
+		return err
+	}
+	return f.file.Close()
+}
+
+// createTempFile creates a file of the temp directory, its content is encrypted while it is written when an encrypter is set
+func createTempFile(name string, enc *encrypter) (io.WriteCloser, error) {
+	file, err := os.Create(filepath.Join(tmpPath, name))
+	if err != nil {
+		return nil, err
+	}
+	if enc == nil {
+		return file, nil
+	}
+	writer, err := enc.writer(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return &encryptedFile{WriteCloser: writer, file: file}, nil
+}
+
+// encryptTempFile encrypts a file of the temp directory to its encrypted name, the plain file is removed
+func encryptTempFile(name string, enc *encrypter) error {
+	input, err := os.Open(filepath.Join(tmpPath, name))
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	output, err := createTempFile(enc.fileName(name), enc)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(output, input); err != nil {
+		_ = output.Close()
+		return err
+	}
+	if err := output.Close(); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(tmpPath, name))
+}
+
+// encryptionExtension returns the extension of an encrypted file name, gpg or age, and an empty string for other files
+func encryptionExtension(name string) string {
+	switch ext := strings.TrimPrefix(filepath.Ext(name), "."); ext {
+	case gpgExtension, ageExtension:
+		return ext
+	}
+	return ""
+}
+
+// trimEncryptionExtension returns the name of a file before it was encrypted
+func trimEncryptionExtension(name string) string {
+	if ext := encryptionExtension(name); ext != "" {
+		return strings.TrimSuffix(name, "."+ext)
+	}
+	return name
+}
+
+// decryptReader decrypts a GPG stream while it is read, with the private keys or the passphrase.
+// The integrity of the content is checked at its end, the stream must be read until io.EOF.
+func decryptReader(reader io.Reader, keys openpgp.EntityList, passphrase []byte) (io.Reader, error) {
+	prompted := false
+	message, err := openpgp.ReadMessage(reader, keys, func(_ []openpgp.Key, symmetric bool) ([]byte, error) {
+		if !symmetric || len(passphrase) == 0 {
+			return nil, errors.New("no private key matches the recipients of the file")
+		}
+		// The prompt is called again when the passphrase is wrong
+		if prompted {
+			return nil, errors.New("invalid passphrase")
+		}
+		prompted = true
+		return passphrase, nil
+	}, nil)
+	if errors.Is(err, pgpErrors.ErrKeyIncorrect) {
+		return nil, errors.New("no private key matches the recipients of the file")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return message.UnverifiedBody, nil
+}
+
+// decrypter decrypts backups with a passphrase or the private keys of a key file, the key file is read once
+type decrypter struct {
+	passphrase []byte
+	keyFile    string
+	// keyPassphrase unlocks the OpenPGP private keys of the key file
+	keyPassphrase []byte
+	keys          openpgp.EntityList
+	identities    []age.Identity
+}
+
+// restoreDecrypter decrypts the restored backups, it is created from the environment on first use
+var restoreDecrypter *decrypter
+
+// decryptStream decrypts the stream of a stored file if it is a GPG or age file, other streams are returned unchanged
+func decryptStream(name string, stream io.Reader) (io.Reader, error) {
+	if restoreDecrypter == nil {
+		passphrase, err := utils.GetSecretBytes("GPG_PASSPHRASE")
+		if err != nil {
+			return nil, err
+		}
+		keyPassphrase, err := utils.GetSecretBytes("RESTORE_PRIVATE_KEY_PASSPHRASE")
+		if err != nil {
+			clear(passphrase)
+			return nil, err
+		}
+		restoreDecrypter = &decrypter{
+			passphrase:    passphrase,
+			keyFile:       os.Getenv("RESTORE_PRIVATE_KEY_FILE"),
+			keyPassphrase: keyPassphrase,
+		}
+	}
+	return restoreDecrypter.stream(name, stream)
+}
+
+// wipeRestoreKeys clears the passphrases of the restore decrypter from memory, they are read again on next use
+func wipeRestoreKeys() {
+	if restoreDecrypter == nil {
+		return
+	}
+	clear(restoreDecrypter.passphrase)
+	clear(restoreDecrypter.keyPassphrase)
+	restoreDecrypter = nil
+}
+
+// stream decrypts the stream of a stored file if it is a GPG or age file, other streams are returned unchanged
+func (d *decrypter) stream(name string, stream io.Reader) (io.Reader, error) {
+	var reader io.Reader
+	var err error
+	switch encryptionExtension(name) {
+	case gpgExtension:
+		if len(d.passphrase) == 0 && d.keyFile == "" {
+			return nil, fmt.Errorf("GPG_PASSPHRASE or RESTORE_PRIVATE_KEY_FILE environment variable is required to read %s", name)
+		}
+		var keys openpgp.EntityList
+		if keys, err = d.privateKeys(); err == nil {
+			reader, err = decryptReader(stream, keys, d.passphrase)
+		}
+	case ageExtension:
+		if d.keyFile == "" {
+			return nil, fmt.Errorf("RESTORE_PRIVATE_KEY_FILE environment variable is required to read %s", name)
+		}
+		var identities []age.Identity
+		if identities, err = d.ageIdentities(); err == nil {
+			reader, err = age.Decrypt(stream, identities...)
+		}
+	default:
+		return stream, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting %s: %w", name, err)
+	}
+	return reader, nil
+}
+
+// privateKeys reads and unlocks the OpenPGP private keys of the key file, if any
+func (d *decrypter) privateKeys() (openpgp.EntityList, error) {
+	if d.keyFile == "" || d.keys != nil {
+		return d.keys, nil
+	}
+	keys, err := readKeyRing(d.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading private key %s: %w", d.keyFile, err)
+	}
+	for _, key := range keys {
+		if key.PrivateKey == nil {
+			return nil, fmt.Errorf("%s is not a private key", d.keyFile)
+		}
+		if err := key.DecryptPrivateKeys(d.keyPassphrase); err != nil {
+			return nil, fmt.Errorf("error unlocking private key %s, check RESTORE_PRIVATE_KEY_PASSPHRASE: %w", d.keyFile, err)
+		}
+	}
+	d.keys = keys
+	return keys, nil
+}
+
+// ageIdentities reads the age identities of the key file
+func (d *decrypter) ageIdentities() ([]age.Identity, error) {
+	if d.identities != nil {
+		return d.identities, nil
+	}
+	file, err := os.Open(d.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	identities, err := age.ParseIdentities(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading age identities %s: %w", d.keyFile, err)
+	}
+	d.identities = identities
+	return identities, nil
+}
@@ -0,0 +1,495 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/jkaninda/volume-backup/utils"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// maxSymlinks is the maximum number of symlinks followed when resolving a path, like the Linux kernel
+const maxSymlinks = 40
+
+// rejectedEntry is an archive entry that has not been extracted
+type rejectedEntry struct {
+	name   string
+	reason string
+}
+
+// extractor extracts archives under a root directory. Entries escaping the root, written through
+// symlinks, or exceeding the configured sizes are rejected and reported in the restore summary.
+type extractor struct {
+	root string
+	// target is the directory the root is moved to once extracted, absolute symlinks are resolved against it
+	target string
+	// overlay resolves the paths missing from the root in the target, whose files are kept by the restore
+	overlay bool
+	// maxEntrySize is the maximum size of an entry, 0 for unlimited
+	maxEntrySize int64
+	// maxTotalSize is the maximum extracted size, 0 for unlimited
+	maxTotalSize int64
+	totalSize    int64
+	restored     int
+	rejected     []rejectedEntry
+	// Directories metadata is restored last, extracting their content changes their modification time
+	dirs []*tar.Header
+	// Symlinks are checked again once everything is extracted, a symlink can be redirected by the next entries
+	symlinks []string
+	// members restores only these paths and their content, all paths when empty
+	members []string
+	// filter selects the restored paths with include and exclude patterns, nil to restore all paths
+	filter *pathFilter
+	// manifest is read from the manifest members of the archive, nil for archives without manifest
+	manifest *backupManifest
+	// checksums of the regular files listed in the complete manifest, nil until it is read
+	checksums map[string]string
+	// unchecked are the regular files extracted before the complete manifest, the last member of older archives, is read
+	unchecked map[string]extractedFile
+	// plan collects the entries of a dry-run restore instead of extracting them, nil to extract
+	plan *restorePlan
+}
+
+// extractedFile is a regular file extracted before its checksum is known
+type extractedFile struct {
+	path string
+	sum  string
+}
+
+// Default extraction limits, a decompression bomb fails the restore before filling the disk.
+// They are changed with RESTORE_MAX_ENTRY_SIZE and RESTORE_MAX_SIZE, 0 for unlimited.
+const (
+	defaultMaxEntrySize = 64 << 30
+	defaultMaxTotalSize = 1 << 40
+)
+
+// newExtractor creates an extractor, limits are read from RESTORE_MAX_ENTRY_SIZE and RESTORE_MAX_SIZE
+func newExtractor(opts restoreOptions) *extractor {
+	e := &extractor{root: filepath.Clean(opts.root), members: opts.members, filter: opts.filter, overlay: opts.overlay, plan: opts.plan}
+	e.target = e.root
+	if opts.target != "" {
+		e.target = filepath.Clean(opts.target)
+	}
+	e.maxEntrySize = sizeLimit("RESTORE_MAX_ENTRY_SIZE", defaultMaxEntrySize)
+	e.maxTotalSize = sizeLimit("RESTORE_MAX_SIZE", defaultMaxTotalSize)
+	return e
+}
+
+// sizeLimit reads a size limit from an environment variable, the default is used when it is not set
+func sizeLimit(envName string, defaultSize int64) int64 {
+	value := os.Getenv(envName)
+	if value == "" {
+		return defaultSize
+	}
+	size, err := utils.ParseSize(value)
+	if err != nil {
+		utils.Fatal("Invalid %s: %v", envName, err)
+	}
+	return size
+}
+
+// selected reports whether an archive path is one of the restored members or inside one of them,
+// and is selected by the include and exclude patterns. Members can be globs.
+func (e *extractor) selected(name string, isDir bool) bool {
+	name = path.Clean(strings.TrimPrefix(filepath.ToSlash(name), "./"))
+	if e.filter != nil && !e.filter.selects(name, isDir) {
+		return false
+	}
+	if len(e.members) == 0 {
+		return true
+	}
+	for _, member := range e.members {
+		if name == member || strings.HasPrefix(name, member+"/") {
+			return true
+		}
+		if matched, _ := path.Match(member, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// reject records an entry that is not extracted
+func (e *extractor) reject(name, reason string) {
+	utils.Warn("Rejected %s: %s", name, reason)
+	e.rejected = append(e.rejected, rejectedEntry{name: name, reason: reason})
+}
+
+// within reports whether a cleaned absolute path is the root or inside it
+func (e *extractor) within(path string) bool {
+	return path == e.root || strings.HasPrefix(path, e.root+string(os.PathSeparator))
+}
+
+// staged maps an absolute path of the target to the root, the path is returned unchanged when it is outside the target
+func (e *extractor) staged(path string) string {
+	if e.target == e.root || e.within(path) {
+		return path
+	}
+	if path == e.target || strings.HasPrefix(path, e.target+string(os.PathSeparator)) {
+		rel, _ := filepath.Rel(e.target, path)
+		return filepath.Join(e.root, rel)
+	}
+	return path
+}
+
+// safePath returns the path an entry is extracted to. It fails if the name is absolute,
+// escapes the root, or if one of its parent directories is a symlink.
+func (e *extractor) safePath(name string) (string, error) {
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") {
+		return "", errors.New("absolute path")
+	}
+	path := filepath.Join(e.root, name)
+	if !e.within(path) {
+		return "", errors.New("path escapes the restore directory")
+	}
+	// Parent directories must not be symlinks, an archive could create a symlink and write through it
+	rel, _ := filepath.Rel(e.root, filepath.Dir(path))
+	current := e.root
+	for _, component := range strings.Split(rel, string(os.PathSeparator)) {
+		if component == "." || component == "" {
+			continue
+		}
+		current = filepath.Join(current, component)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("parent directory %s is a symlink", strings.TrimPrefix(current, e.root+"/"))
+		}
+	}
+	return path, nil
+}
+
+// checkSymlink fails if a symlink created at path with the given target points outside the root
+func (e *extractor) checkSymlink(path, target string) error {
+	resolved := e.staged(filepath.Clean(target))
+	if !filepath.IsAbs(target) {
+		resolved = filepath.Clean(filepath.Join(filepath.Dir(path), target))
+	}
+	if !e.within(resolved) {
+		return fmt.Errorf("symlink target %s is outside the restore directory", target)
+	}
+	return nil
+}
+
+// resolvesInside reports whether a path resolves inside the root, following symlinks like the kernel does
+func (e *extractor) resolvesInside(path string) bool {
+	rel, err := filepath.Rel(e.root, path)
+	if err != nil {
+		return false
+	}
+	remaining := strings.Split(rel, string(os.PathSeparator))
+	current := e.root
+	followed := 0
+	for len(remaining) > 0 {
+		component := remaining[0]
+		remaining = remaining[1:]
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			current = filepath.Dir(current)
+			if !e.within(current) {
+				return false
+			}
+			continue
+		}
+		next := filepath.Join(current, component)
+		link := next
+		info, err := os.Lstat(next)
+		if err != nil && e.overlay {
+			// The existing files of the target are kept, they are part of the restored tree
+			rel, _ := filepath.Rel(e.root, next)
+			link = filepath.Join(e.target, rel)
+			info, err = os.Lstat(link)
+		}
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+		followed++
+		if followed > maxSymlinks {
+			return false
+		}
+		target, err := os.Readlink(link)
+		if err != nil {
+			return false
+		}
+		if filepath.IsAbs(target) {
+			target = e.staged(filepath.Clean(target))
+			if !e.within(target) {
+				return false
+			}
+			rel, _ := filepath.Rel(e.root, target)
+			remaining = append(strings.Split(rel, string(os.PathSeparator)), remaining...)
+			current = e.root
+			continue
+		}
+		remaining = append(strings.Split(target, string(os.PathSeparator)), remaining...)
+	}
+	return e.within(current)
+}
+
+// checkSize accounts the size of an entry, it fails if the maximum total size is exceeded
+func (e *extractor) checkSize(name string, size int64) (bool, error) {
+	if e.maxEntrySize > 0 && size > e.maxEntrySize {
+		e.reject(name, fmt.Sprintf("entry size %d exceeds the maximum entry size %d", size, e.maxEntrySize))
+		return false, nil
+	}
+	e.totalSize += size
+	if e.maxTotalSize > 0 && e.totalSize > e.maxTotalSize {
+		return false, fmt.Errorf("maximum extracted size %d exceeded at %s, the archive may be a decompression bomb", e.maxTotalSize, name)
+	}
+	return true, nil
+}
+
+// extract extracts a tar stream, with symlinks, hard links, special files, owners,
+// modification times and extended attributes
+func (e *extractor) extract(reader io.Reader) error {
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if isManifest(header) {
+			if err := e.readManifest(tarReader, header); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := e.extractEntry(tarReader, header); err != nil {
+			return err
+		}
+	}
+	return e.finish()
+}
+
+// extractEntry extracts a single tar entry, invalid entries are rejected and skipped
+func (e *extractor) extractEntry(tarReader *tar.Reader, header *tar.Header) error {
+	if !e.selected(header.Name, header.Typeflag == tar.TypeDir) {
+		return nil
+	}
+	outputPath, err := e.safePath(header.Name)
+	if err != nil {
+		e.reject(header.Name, err.Error())
+		return nil
+	}
+	if header.Typeflag != tar.TypeDir {
+		if outputPath == e.root {
+			e.reject(header.Name, "invalid file name")
+			return nil
+		}
+		// Create all parent directories if necessary
+		if e.plan == nil {
+			if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+				return err
+			}
+		}
+	}
+	if e.plan != nil {
+		return e.planEntry(tarReader, header, outputPath)
+	}
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(outputPath, 0755); err != nil {
+			return err
+		}
+		e.dirs = append(e.dirs, header)
+		e.restored++
+		return nil
+	case tar.TypeReg:
+		ok, err := e.checkSize(header.Name, header.Size)
+		if err != nil || !ok {
+			return err
+		}
+		sum, err := extractFile(outputPath, tarReader)
+		if err != nil {
+			return err
+		}
+		if !e.checkSum(header.Name, outputPath, sum) {
+			return os.Remove(outputPath)
+		}
+	case tar.TypeSymlink:
+		if err := e.checkSymlink(outputPath, header.Linkname); err != nil {
+			e.reject(header.Name, err.Error())
+			return nil
+		}
+		err = replaceFile(outputPath, func() error {
+			return os.Symlink(header.Linkname, outputPath)
+		})
+		if err != nil {
+			return err
+		}
+		e.symlinks = append(e.symlinks, outputPath)
+	case tar.TypeLink:
+		target, err := e.safePath(header.Linkname)
+		if err != nil {
+			e.reject(header.Name, fmt.Sprintf("hard link target: %v", err))
+			return nil
+		}
+		if info, err := os.Lstat(target); err != nil || !info.Mode().IsRegular() {
+			e.reject(header.Name, fmt.Sprintf("hard link target %s is not a regular file", header.Linkname))
+			return nil
+		}
+		// Hard links share the metadata of their target
+		err = replaceFile(outputPath, func() error {
+			return os.Link(target, outputPath)
+		})
+		if err != nil {
+			return err
+		}
+		e.restored++
+		return nil
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		err = replaceFile(outputPath, func() error {
+			return makeSpecialFile(outputPath, header)
+		})
+		if err != nil {
+			return err
+		}
+	default:
+		e.reject(header.Name, fmt.Sprintf("unsupported file type %c", header.Typeflag))
+		return nil
+	}
+	applyMetadata(outputPath, header)
+	e.restored++
+	return nil
+}
+
+// readManifest reads a manifest member of the archive. Once the complete manifest is read,
+// the files extracted before it are checked against its checksums.
+func (e *extractor) readManifest(reader io.Reader, header *tar.Header) error {
+	manifest, err := readManifest(reader)
+	if err != nil {
+		return err
+	}
+	if e.manifest == nil {
+		utils.Info("Backup of %s from %s, created by version %s at %s", manifest.Source, manifest.Host, manifest.AppVersion, manifest.StartTime.Format(utils.TimeFormat()))
+	}
+	e.manifest = manifest
+	if isManifestHeader(header) {
+		return nil
+	}
+	e.checksums = manifest.checksums()
+	for name, file := range e.unchecked {
+		if e.checkSum(name, file.path, file.sum) {
+			continue
+		}
+		e.restored--
+		if e.plan != nil {
+			e.plan.drop(name)
+			continue
+		}
+		if err := os.Remove(file.path); err != nil {
+			return err
+		}
+	}
+	e.unchecked = nil
+	return nil
+}
+
+// checkSum checks the SHA-256 of a regular file against the manifest, a corrupted file is rejected.
+// Files read before the complete manifest are recorded, they are checked once it is read.
+func (e *extractor) checkSum(name, outputPath, sum string) bool {
+	if e.checksums == nil {
+		if e.unchecked == nil {
+			e.unchecked = make(map[string]extractedFile)
+		}
+		e.unchecked[name] = extractedFile{path: outputPath, sum: sum}
+		return true
+	}
+	if expected, ok := e.checksums[name]; ok && expected != sum {
+		e.reject(name, "checksum mismatch, the file is corrupted")
+		return false
+	}
+	return true
+}
+
+// finish restores directories metadata and removes the symlinks resolving outside the root.
+// It fails if the archive has a manifest header but no complete manifest, its files cannot be checked.
+func (e *extractor) finish() error {
+	if e.manifest != nil && e.checksums == nil {
+		return fmt.Errorf("the complete manifest is missing, the archive is truncated")
+	}
+	for _, path := range e.symlinks {
+		if !e.resolvesInside(path) {
+			rel, _ := filepath.Rel(e.root, path)
+			e.reject(rel, "symlink resolves outside the restore directory")
+			e.restored--
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	for i := len(e.dirs) - 1; i >= 0; i-- {
+		path, err := e.safePath(e.dirs[i].Name)
+		if err != nil {
+			continue
+		}
+		applyMetadata(path, e.dirs[i])
+	}
+	return nil
+}
+
+// summary prints the number of extracted and rejected entries
+func (e *extractor) summary() {
+	if e.plan != nil {
+		utils.Info("Dry run summary: %d entries compared, %d entries rejected", e.restored, len(e.rejected))
+		for _, entry := range e.rejected {
+			utils.Warn("  rejected %s: %s", entry.name, entry.reason)
+		}
+		return
+	}
+	utils.Info("Restore summary: %d entries restored, %d entries rejected", e.restored, len(e.rejected))
+	for _, entry := range e.rejected {
+		utils.Warn("  rejected %s: %s", entry.name, entry.reason)
+	}
+}
+
+// extractFile writes the content of a tar entry to a new file, it returns the SHA-256 of the content
+func extractFile(outputPath string, reader io.Reader) (string, error) {
+	h := sha256.New()
+	err := replaceFile(outputPath, func() error {
+		outFile, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.MultiWriter(outFile, h), reader); err != nil {
+			outFile.Close()
+			return err
+		}
+		return outFile.Close()
+	})
+	return hex.EncodeToString(h.Sum(nil)), err
+}
+
+// replaceFile removes an existing file before creating the new one,
+// existing symlinks are not followed and existing hard links are not modified
+func replaceFile(outputPath string, create func() error) error {
+	if info, err := os.Lstat(outputPath); err == nil && !info.IsDir() {
+		if err := os.Remove(outputPath); err != nil {
+			return err
+		}
+	}
+	return create()
+}
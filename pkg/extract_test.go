@@ -0,0 +1,257 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// testEntry is a member of a crafted tar stream, content is the data of regular files and pax the manifest kind
+type testEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	content  string
+	pax      string
+}
+
+// tarStream writes the entries to a tar stream
+func tarStream(t *testing.T, entries []testEntry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Typeflag: entry.typeflag, Linkname: entry.linkname, Mode: 0644}
+		if entry.typeflag == tar.TypeDir {
+			header.Mode = 0755
+		}
+		if entry.typeflag == tar.TypeReg {
+			header.Size = int64(len(entry.content))
+		}
+		if entry.pax != "" {
+			header.Format = tar.FormatPAX
+			header.PAXRecords = map[string]string{paxManifestKey: entry.pax}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestExtractRejectsUnsafeEntries(t *testing.T) {
+	tests := []struct {
+		name         string
+		entries      []testEntry
+		maxEntrySize int64
+		maxTotalSize int64
+		wantErr      bool
+		wantRejected []string
+		wantFiles    []string
+	}{
+		{
+			name: "parent directory traversal",
+			entries: []testEntry{
+				{name: "../escape", typeflag: tar.TypeReg, content: "escape"},
+				{name: "a/../../escape", typeflag: tar.TypeReg, content: "escape"},
+				{name: "ok", typeflag: tar.TypeReg, content: "ok"},
+			},
+			wantRejected: []string{"../escape", "a/../../escape"},
+			wantFiles:    []string{"ok"},
+		},
+		{
+			name: "absolute path",
+			entries: []testEntry{
+				{name: "/escape", typeflag: tar.TypeReg, content: "escape"},
+				{name: "ok", typeflag: tar.TypeReg, content: "ok"},
+			},
+			wantRejected: []string{"/escape"},
+			wantFiles:    []string{"ok"},
+		},
+		{
+			name: "symlink outside the root",
+			entries: []testEntry{
+				{name: "link", typeflag: tar.TypeSymlink, linkname: "../"},
+				{name: "abs", typeflag: tar.TypeSymlink, linkname: "/"},
+			},
+			wantRejected: []string{"link", "abs"},
+		},
+		{
+			name: "write through a symlink",
+			entries: []testEntry{
+				{name: "link", typeflag: tar.TypeSymlink, linkname: "."},
+				{name: "link/escape", typeflag: tar.TypeReg, content: "escape"},
+			},
+			wantRejected: []string{"link/escape"},
+			wantFiles:    []string{"link"},
+		},
+		{
+			name: "symlink resolving outside through another symlink",
+			entries: []testEntry{
+				{name: "d", typeflag: tar.TypeDir},
+				{name: "s", typeflag: tar.TypeSymlink, linkname: "."},
+				{name: "d/l", typeflag: tar.TypeSymlink, linkname: "../s/.."},
+			},
+			wantRejected: []string{"d/l"},
+			wantFiles:    []string{"d", "s"},
+		},
+		{
+			name: "hard link outside the root",
+			entries: []testEntry{
+				{name: "hard", typeflag: tar.TypeLink, linkname: "../escape"},
+			},
+			wantRejected: []string{"hard"},
+		},
+		{
+			name: "oversized entry",
+			entries: []testEntry{
+				{name: "big", typeflag: tar.TypeReg, content: "0123456789abcdef"},
+				{name: "small", typeflag: tar.TypeReg, content: "ok"},
+			},
+			maxEntrySize: 8,
+			wantRejected: []string{"big"},
+			wantFiles:    []string{"small"},
+		},
+		{
+			name: "maximum total size",
+			entries: []testEntry{
+				{name: "one", typeflag: tar.TypeReg, content: "0123456789"},
+				{name: "two", typeflag: tar.TypeReg, content: "0123456789"},
+			},
+			maxTotalSize: 15,
+			wantErr:      true,
+			wantFiles:    []string{"one"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := t.TempDir()
+			root := filepath.Join(parent, "root")
+			if err := os.Mkdir(root, 0755); err != nil {
+				t.Fatal(err)
+			}
+			e := newExtractor(restoreOptions{root: root})
+			e.maxEntrySize, e.maxTotalSize = tt.maxEntrySize, tt.maxTotalSize
+			err := e.extract(tarStream(t, tt.entries))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extract() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var rejected []string
+			for _, entry := range e.rejected {
+				rejected = append(rejected, entry.name)
+			}
+			if !slices.Equal(rejected, tt.wantRejected) {
+				t.Errorf("rejected = %v, want %v", rejected, tt.wantRejected)
+			}
+			for _, name := range tt.wantFiles {
+				if _, err := os.Lstat(filepath.Join(root, name)); err != nil {
+					t.Errorf("%s not extracted: %v", name, err)
+				}
+			}
+			// Nothing is written next to the root
+			entries, err := os.ReadDir(parent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Errorf("files written outside the root: %v", entries)
+			}
+		})
+	}
+}
+
+func TestSafePath(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Symlink(".", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	e := newExtractor(restoreOptions{root: root})
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{name: "file", want: filepath.Join(root, "file")},
+		{name: "./dir/file", want: filepath.Join(root, "dir/file")},
+		{name: "dir/../file", want: filepath.Join(root, "file")},
+		{name: "../file", wantErr: true},
+		{name: "dir/../../file", wantErr: true},
+		{name: "/etc/passwd", wantErr: true},
+		{name: "link/file", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := e.safePath(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("safePath(%q) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("safePath(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractRequiresCompleteManifest(t *testing.T) {
+	manifest := func(kind string) testEntry {
+		return testEntry{name: manifestName, typeflag: tar.TypeReg, content: `{"source":"/data"}`, pax: kind}
+	}
+	tests := []struct {
+		name    string
+		entries []testEntry
+		wantErr bool
+	}{
+		{name: "complete manifest first", entries: []testEntry{manifest(manifestComplete), {name: "file", typeflag: tar.TypeReg, content: "ok"}}},
+		{name: "complete manifest last", entries: []testEntry{manifest(manifestHeader), {name: "file", typeflag: tar.TypeReg, content: "ok"}, manifest(manifestComplete)}},
+		{name: "no manifest", entries: []testEntry{{name: "file", typeflag: tar.TypeReg, content: "ok"}}},
+		{name: "truncated after the manifest header", entries: []testEntry{manifest(manifestHeader), {name: "file", typeflag: tar.TypeReg, content: "ok"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newExtractor(restoreOptions{root: t.TempDir()})
+			err := e.extract(tarStream(t, tt.entries))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extract() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExtractorSizeLimits(t *testing.T) {
+	tests := []struct {
+		name          string
+		maxEntrySize  string
+		maxTotalSize  string
+		wantEntrySize int64
+		wantTotalSize int64
+	}{
+		{name: "defaults", wantEntrySize: defaultMaxEntrySize, wantTotalSize: defaultMaxTotalSize},
+		{name: "configured", maxEntrySize: "1GiB", maxTotalSize: "10GiB", wantEntrySize: 1 << 30, wantTotalSize: 10 << 30},
+		{name: "unlimited", maxEntrySize: "0", maxTotalSize: "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("RESTORE_MAX_ENTRY_SIZE", tt.maxEntrySize)
+			t.Setenv("RESTORE_MAX_SIZE", tt.maxTotalSize)
+			e := newExtractor(restoreOptions{root: t.TempDir()})
+			if e.maxEntrySize != tt.wantEntrySize || e.maxTotalSize != tt.wantTotalSize {
+				t.Errorf("limits = %d, %d, want %d, %d", e.maxEntrySize, e.maxTotalSize, tt.wantEntrySize, tt.wantTotalSize)
+			}
+		})
+	}
+}
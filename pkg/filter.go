@@ -0,0 +1,350 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/jkaninda/volume-backup/utils"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// backupIgnoreFile holds gitignore-style rules scoped to its directory, an empty file excludes the directory
+const backupIgnoreFile = ".backupignore"
+
+// ignoreRule is a gitignore-style pattern
+type ignoreRule struct {
+	pattern string
+	regexp  *regexp.Regexp
+	// negate re-includes paths excluded by a previous rule
+	negate bool
+	// dirOnly only matches directories, the pattern ends with a slash
+	dirOnly bool
+	// anchored patterns contain a slash and are matched from the base directory,
+	// other patterns are matched against the name at any depth
+	anchored bool
+}
+
+// parseIgnoreRule parses a gitignore-style pattern, it returns nil for blank lines and comments
+func parseIgnoreRule(pattern string) (*ignoreRule, error) {
+	pattern = strings.TrimRight(pattern, " \t\r")
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return nil, nil
+	}
+	rule := &ignoreRule{pattern: pattern}
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	}
+	// A leading backslash escapes a pattern starting with # or !
+	pattern = strings.TrimPrefix(pattern, `\`)
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if strings.Contains(pattern, "/") {
+		rule.anchored = true
+		pattern = strings.TrimPrefix(pattern, "/")
+	}
+	if pattern == "" {
+		return nil, fmt.Errorf("invalid pattern %q", rule.pattern)
+	}
+	re, err := regexp.Compile(globToRegexp(pattern))
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", rule.pattern, err)
+	}
+	rule.regexp = re
+	return rule, nil
+}
+
+// globToRegexp converts a glob with ** support to a regular expression
+func globToRegexp(pattern string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			if strings.HasPrefix(pattern[i:], "**") {
+				switch {
+				case strings.HasPrefix(pattern[i:], "**/"):
+					b.WriteString("(.*/)?")
+					i += 2
+				default:
+					b.WriteString(".*")
+					i++
+				}
+				continue
+			}
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// match reports whether the rule matches a slash separated path, relative to the rule base directory
+func (r *ignoreRule) match(relPath string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.anchored {
+		return r.regexp.MatchString(relPath)
+	}
+	return r.regexp.MatchString(path.Base(relPath))
+}
+
+// pathFilter selects the paths of a folder backup from include patterns, exclude patterns
+// and the .backupignore files found in the volume
+type pathFilter struct {
+	includes []*ignoreRule
+	excludes []*ignoreRule
+	// ignores holds the .backupignore rules of each walked directory, keyed by its relative path.
+	// They are only read during a walk, each walk has its own copy of the filter.
+	ignores map[string][]*ignoreRule
+}
+
+// newPathFilter creates a filter from include and exclude patterns and an optional exclude file
+func newPathFilter(includes, excludes []string, excludeFile string) (*pathFilter, error) {
+	f := &pathFilter{}
+	for _, pattern := range includes {
+		rule, err := parseIgnoreRule(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if rule != nil {
+			f.includes = append(f.includes, rule)
+		}
+	}
+	if excludeFile != "" {
+		rules, err := readIgnoreFile(excludeFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading exclude file %s: %w", excludeFile, err)
+		}
+		f.excludes = append(f.excludes, rules...)
+	}
+	for _, pattern := range excludes {
+		rule, err := parseIgnoreRule(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if rule != nil {
+			f.excludes = append(f.excludes, rule)
+		}
+	}
+	return f, nil
+}
+
+// readIgnoreFile reads the gitignore-style rules of a file
+func readIgnoreFile(name string) ([]*ignoreRule, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var rules []*ignoreRule
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		rule, err := parseIgnoreRule(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		if rule != nil {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// forWalk returns a copy of the filter for a walk, without the .backupignore rules of previous walks.
+// Scheduled backups and sources share the filter, a deleted .backupignore file must not apply anymore.
+func (f *pathFilter) forWalk() *pathFilter {
+	return &pathFilter{includes: f.includes, excludes: f.excludes, ignores: make(map[string][]*ignoreRule)}
+}
+
+// loadDir reads the .backupignore file of a directory, it reports whether the directory is excluded
+func (f *pathFilter) loadDir(dir, relDir string) (bool, error) {
+	name := filepath.Join(dir, backupIgnoreFile)
+	info, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// An empty marker file excludes the whole directory
+	if info.Size() == 0 {
+		return true, nil
+	}
+	rules, err := readIgnoreFile(name)
+	if err != nil {
+		return false, fmt.Errorf("error reading %s: %w", name, err)
+	}
+	f.ignores[relDir] = rules
+	return false, nil
+}
+
+// excluded reports whether a path is excluded, the last matching rule wins.
+// Rules of --exclude and EXCLUDE_FILE come first, then the .backupignore rules from the root to the deepest directory.
+func (f *pathFilter) excluded(relPath string, isDir bool) bool {
+	excluded := false
+	apply := func(rules []*ignoreRule, rel string) {
+		for _, rule := range rules {
+			if rule.match(rel, isDir) {
+				excluded = !rule.negate
+			}
+		}
+	}
+	apply(f.excludes, relPath)
+	if len(f.ignores) == 0 {
+		return excluded
+	}
+	// .backupignore of the root, then of each parent directory
+	apply(f.ignores["."], relPath)
+	parts := strings.Split(relPath, "/")
+	for i := 1; i < len(parts); i++ {
+		base := strings.Join(parts[:i], "/")
+		if rules, ok := f.ignores[base]; ok {
+			apply(rules, strings.Join(parts[i:], "/"))
+		}
+	}
+	return excluded
+}
+
+// included reports whether a path or one of its parent directories matches an include pattern
+func (f *pathFilter) included(relPath string, isDir bool) bool {
+	if len(f.includes) == 0 {
+		return true
+	}
+	for current := relPath; current != "." && current != "/"; current = path.Dir(current) {
+		for _, rule := range f.includes {
+			if rule.match(current, isDir || current != relPath) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// selects reports whether a restored path is selected, it is excluded when itself or one of its parent directories is excluded
+func (f *pathFilter) selects(relPath string, isDir bool) bool {
+	if !f.included(relPath, isDir) {
+		return false
+	}
+	for current := relPath; current != "." && current != "/"; current = path.Dir(current) {
+		if f.excluded(current, isDir || current != relPath) {
+			return false
+		}
+	}
+	return true
+}
+
+// pendingDir is a directory whose entry is only archived once one of its files is included
+type pendingDir struct {
+	path    string
+	relPath string
+	info    os.FileInfo
+}
+
+// walkFiltered walks a folder and calls fn for each path selected by the filter, parents first.
+// With include patterns, directories are only passed to fn when they contain an included path.
+// Staging directories and the previous content of restores are skipped.
+func walkFiltered(sourceFolder string, filter *pathFilter, fn func(path, relPath string, info os.FileInfo) error) error {
+	var pending []pendingDir
+	if filter != nil {
+		filter = filter.forWalk()
+	}
+	return filepath.Walk(sourceFolder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Files can be removed from a live volume while it is being walked
+			if os.IsNotExist(err) {
+				utils.Warn("%s has been removed during backup, skipping", path)
+				return nil
+			}
+			return err
+		}
+		// Get the relative path to maintain the folder structure
+		relPath, err := filepath.Rel(sourceFolder, path)
+		if err != nil {
+			return err
+		}
+		// A restore to the backed up folder can be running
+		if relPath != "." && info.IsDir() && isRestoreDir(info.Name()) {
+			utils.Info("Skipping %s, restore directory", relPath)
+			return filepath.SkipDir
+		}
+		if filter == nil {
+			return fn(path, relPath, info)
+		}
+		slashPath := filepath.ToSlash(relPath)
+		if relPath != "." {
+			if filter.excluded(slashPath, info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		if info.IsDir() {
+			excluded, err := filter.loadDir(path, slashPath)
+			if err != nil {
+				return err
+			}
+			if excluded {
+				utils.Info("Skipping %s, excluded by %s", relPath, backupIgnoreFile)
+				return filepath.SkipDir
+			}
+		}
+		// Drop the pending directories that are not parents of this path
+		for len(pending) > 0 {
+			parent := pending[len(pending)-1].relPath
+			if parent == "." || strings.HasPrefix(relPath, parent+string(os.PathSeparator)) {
+				break
+			}
+			pending = pending[:len(pending)-1]
+		}
+		if !filter.included(slashPath, info.IsDir()) {
+			if info.IsDir() {
+				pending = append(pending, pendingDir{path: path, relPath: relPath, info: info})
+			}
+			return nil
+		}
+		// Parent directories are archived before their first included path
+		for _, dir := range pending {
+			if err := fn(dir.path, dir.relPath, dir.info); err != nil {
+				return err
+			}
+		}
+		pending = pending[:0]
+		return fn(path, relPath, info)
+	})
+}
@@ -0,0 +1,191 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestIgnoreRuleMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		isDir   bool
+		want    bool
+	}{
+		{pattern: "*.log", path: "app.log", want: true},
+		{pattern: "*.log", path: "logs/app.log", want: true},
+		{pattern: "*.log", path: "app.log.gz", want: false},
+		{pattern: "cache/", path: "cache", isDir: true, want: true},
+		{pattern: "cache/", path: "cache", isDir: false, want: false},
+		{pattern: "cache/", path: "app/cache", isDir: true, want: true},
+		{pattern: "/tmp", path: "tmp", isDir: true, want: true},
+		{pattern: "/tmp", path: "app/tmp", isDir: true, want: false},
+		{pattern: "app/*.tmp", path: "app/a.tmp", want: true},
+		{pattern: "app/*.tmp", path: "app/sub/a.tmp", want: false},
+		{pattern: "app/**/*.tmp", path: "app/sub/deep/a.tmp", want: true},
+		{pattern: "app/**/*.tmp", path: "app/a.tmp", want: true},
+		{pattern: "**/node_modules", path: "web/node_modules", isDir: true, want: true},
+		{pattern: "data/**", path: "data/a/b", want: true},
+		{pattern: "file?.txt", path: "file1.txt", want: true},
+		{pattern: "file?.txt", path: "file10.txt", want: false},
+		{pattern: "[ab].txt", path: "b.txt", want: true},
+		{pattern: "[!ab].txt", path: "b.txt", want: false},
+		{pattern: `\#notes`, path: "#notes", want: true},
+		{pattern: "!keep.log", path: "keep.log", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.path, func(t *testing.T) {
+			rule, err := parseIgnoreRule(tt.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rule.match(tt.path, tt.isDir); got != tt.want {
+				t.Errorf("match(%q) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseIgnoreRuleSkipsBlankLines(t *testing.T) {
+	for _, pattern := range []string{"", "   ", "# comment"} {
+		rule, err := parseIgnoreRule(pattern)
+		if rule != nil || err != nil {
+			t.Errorf("parseIgnoreRule(%q) = %v, %v, want nil", pattern, rule, err)
+		}
+	}
+	if _, err := parseIgnoreRule("/"); err == nil {
+		t.Error("parseIgnoreRule(\"/\") succeeded, want an error")
+	}
+}
+
+// writeTree creates files in a directory, names ending with a slash are directories
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWalkFiltered(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string
+		includes []string
+		excludes []string
+		want     []string
+	}{
+		{
+			name:     "exclude patterns",
+			files:    map[string]string{"a.log": "", "a.txt": "", "cache/x": ""},
+			excludes: []string{"*.log", "cache/"},
+			want:     []string{"a.txt"},
+		},
+		{
+			name:     "include patterns keep the parent directories",
+			files:    map[string]string{"app/conf/a.yaml": "", "app/data/b": "", "other": ""},
+			includes: []string{"app/conf"},
+			want:     []string{"app", "app/conf", "app/conf/a.yaml"},
+		},
+		{
+			name:  "backupignore negation",
+			files: map[string]string{".backupignore": "*.log\n!keep.log\n", "a.log": "", "keep.log": "", "sub/b.log": "", "sub/keep.log": ""},
+			want:  []string{".backupignore", "keep.log", "sub", "sub/keep.log"},
+		},
+		{
+			name:  "nested backupignore re-includes",
+			files: map[string]string{".backupignore": "*.log\n", "a.log": "", "logs/.backupignore": "!important.log\n", "logs/important.log": "", "logs/debug.log": ""},
+			want:  []string{".backupignore", "logs", "logs/.backupignore", "logs/important.log"},
+		},
+		{
+			name:     "backupignore negation overrides exclude patterns",
+			files:    map[string]string{".backupignore": "!keep.tmp\n", "a.tmp": "", "keep.tmp": ""},
+			excludes: []string{"*.tmp"},
+			want:     []string{".backupignore", "keep.tmp"},
+		},
+		{
+			name:  "backupignore rules are relative to their directory",
+			files: map[string]string{"app/.backupignore": "/build\n", "app/build/x": "", "app/src/build/y": ""},
+			want:  []string{"app", "app/.backupignore", "app/src", "app/src/build", "app/src/build/y"},
+		},
+		{
+			name:  "empty backupignore excludes the directory",
+			files: map[string]string{"cache/.backupignore": "", "cache/x": "", "data/y": ""},
+			want:  []string{"data", "data/y"},
+		},
+		{
+			name:  "excluded directories are not walked",
+			files: map[string]string{".backupignore": "tmp/\n", "tmp/.backupignore": "!keep\n", "tmp/keep": ""},
+			want:  []string{".backupignore"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			writeTree(t, root, tt.files)
+			filter, err := newPathFilter(tt.includes, tt.excludes, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			err = walkFiltered(root, filter, func(_, relPath string, _ os.FileInfo) error {
+				if relPath != "." {
+					got = append(got, filepath.ToSlash(relPath))
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("walked %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPathFilterSelects(t *testing.T) {
+	filter, err := newPathFilter([]string{"app/"}, []string{"*.log", "!keep.log", "app/cache/"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{path: "app", isDir: true, want: true},
+		{path: "app/main.go", want: true},
+		{path: "app/debug.log", want: false},
+		{path: "app/keep.log", want: true},
+		{path: "app/cache/x", want: false},
+		{path: "other/main.go", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := filter.selects(tt.path, tt.isDir); got != tt.want {
+				t.Errorf("selects(%q) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
@@ -8,7 +8,9 @@ package pkg
 
 import (
 	"github.com/jkaninda/volume-backup/utils"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 )
@@ -50,3 +52,64 @@ func RemoveLastExtension(filename string) string {
 	}
 	return filename
 }
+
+// readTempFile reads a file from the temp directory, decrypting it if it is a GPG or age file
+func readTempFile(name string) ([]byte, error) {
+	name, err := decryptTempFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(filepath.Join(tmpPath, name))
+}
+
+// decryptTempFile decrypts a GPG or age file of the temp directory, it returns the name of the decrypted file
+func decryptTempFile(name string) (string, error) {
+	if encryptionExtension(name) == "" {
+		return name, nil
+	}
+	input, err := os.Open(filepath.Join(tmpPath, name))
+	if err != nil {
+		return "", err
+	}
+	defer input.Close()
+	reader, err := decryptStream(name, input)
+	if err != nil {
+		return "", err
+	}
+	output, err := os.Create(filepath.Join(tmpPath, trimEncryptionExtension(name)))
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(output, reader); err != nil {
+		_ = output.Close()
+		return "", err
+	}
+	if err := output.Close(); err != nil {
+		return "", err
+	}
+	return trimEncryptionExtension(name), nil
+}
+
+// memberPath normalizes a path given on the command line to a path relative to the data path.
+// It reports false if the path is outside the data path.
+func memberPath(name string) (string, bool) {
+	name = filepath.ToSlash(strings.TrimSpace(name))
+	if name == dataPath || strings.HasPrefix(name, dataPath+"/") {
+		name = strings.TrimPrefix(name, dataPath)
+	}
+	name = path.Clean(strings.TrimPrefix(name, "/"))
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return "", false
+	}
+	return name, true
+}
+
+// filesBackupName returns the name of a files backup, the file name when a single file is backed up
+func filesBackupName(config *BackupConfig) string {
+	if len(config.files) == 1 && !strings.ContainsAny(config.files[0], "*?[") {
+		if name, ok := memberPath(config.files[0]); ok && name != "." {
+			return path.Base(name)
+		}
+	}
+	return config.prefix
+}
@@ -0,0 +1,199 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"github.com/jkaninda/volume-backup/utils"
+	"github.com/spf13/cobra"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// backupNamePattern matches the prefix_20060102_150405 backup names
+var backupNamePattern = regexp.MustCompile(`^(.+)_(\d{8}_\d{6})[._]`)
+
+// partNamePattern matches the volumes of a split archive, the volumes of a rekeyed archive have the .rekey extension
+var partNamePattern = regexp.MustCompile(`^(.+?)(?:\.rekey\d+)?\.part\d{3,}$`)
+
+// backupFile is a backup stored on a storage, an archive, a split archive or a repository snapshot
+type backupFile struct {
+	Name      string    `json:"name"`
+	Prefix    string    `json:"prefix"`
+	Time      time.Time `json:"time"`
+	Size      int64     `json:"size"`
+	Encrypted bool      `json:"encrypted"`
+	Split     bool      `json:"split,omitempty"`
+	Format    string    `json:"format"`
+	// Source is the backed up path recorded in the manifest, empty if it cannot be read
+	Source string `json:"source,omitempty"`
+}
+
+func StartList(cmd *cobra.Command) {
+	conf := initListConfig(cmd)
+	b := openBackend(conf.storage, conf.remotePath, conf.source)
+	backups, err := listBackups(b)
+	if err != nil {
+		utils.Fatal("Error listing backups: %v", err)
+	}
+	backups = filterPrefix(backups, conf.prefix)
+	for i := range backups {
+		backups[i].Source = storedManifestSource(b, backups[i])
+	}
+	if conf.output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(backups); err != nil {
+			utils.Fatal("Error writing backups: %v", err)
+		}
+		return
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tTIME\tSIZE\tENCRYPTED\tSOURCE")
+	for _, backup := range backups {
+		source := backup.Source
+		if source == "" {
+			source = "-"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%t\t%s\n", backup.Name, backup.Time.Format("2006-01-02 15:04:05"), utils.FormatSize(backup.Size), backup.Encrypted, source)
+	}
+	_ = writer.Flush()
+}
+
+// listBackups lists the backups of a storage directory, oldest first.
+// Split archives are listed once with the size of all their volumes.
+func listBackups(b backend) ([]backupFile, error) {
+	files, err := b.List()
+	if err != nil {
+		return nil, err
+	}
+	backups := make(map[string]*backupFile)
+	partSizes := make(map[string]int64)
+	for _, file := range files {
+		name := file.name
+		if match := partNamePattern.FindStringSubmatch(name); match != nil {
+			partSizes[match[1]] += file.size
+			continue
+		}
+		backup := &backupFile{Name: name, Size: file.size, Time: file.modTime, Format: formatArchive}
+		switch {
+		case strings.HasSuffix(name, ".parts.json"):
+			backup.Name = strings.TrimSuffix(name, ".parts.json")
+			backup.Split = true
+			backup.Size = 0
+		case isRepositorySnapshot(name):
+			backup.Format = formatRepository
+		case !isArchiveName(name):
+			continue
+		}
+		backup.Encrypted = encryptionExtension(backup.Name) != ""
+		if match := backupNamePattern.FindStringSubmatch(backup.Name); match != nil {
+			backup.Prefix = backupPrefix(backup.Name)
+			if t, err := time.ParseInLocation("20060102_150405", match[2], time.Local); err == nil {
+				backup.Time = t
+			}
+		}
+		backups[backup.Name] = backup
+	}
+	list := make([]backupFile, 0, len(backups))
+	for name, backup := range backups {
+		if backup.Split {
+			backup.Size = partSizes[name]
+		}
+		list = append(list, *backup)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Time.Equal(list[j].Time) {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Time.Before(list[j].Time)
+	})
+	return list, nil
+}
+
+// isArchiveName reports whether a file name is a backup archive
+func isArchiveName(name string) bool {
+	name = trimEncryptionExtension(name)
+	for _, codec := range []string{codecGzip, codecZstd, codecXz, codecLz4, codecNone} {
+		if strings.HasSuffix(name, "."+archiveExtension(codec)) {
+			return true
+		}
+	}
+	return false
+}
+
+// storedManifestSource reads the source path from the manifest of a stored archive.
+// Only the beginning of the archive is read, the manifest of encrypted archives and repository snapshots cannot be read.
+func storedManifestSource(b backend, backup backupFile) string {
+	if backup.Encrypted || backup.Format != formatArchive {
+		return ""
+	}
+	name := backup.Name
+	if backup.Split {
+		name = partName(backup.Name, 1)
+	}
+	manifest, err := readStoredManifest(b, name)
+	if err != nil {
+		utils.Warn("Error reading the manifest of %s: %v", backup.Name, err)
+		return ""
+	}
+	if manifest == nil {
+		return ""
+	}
+	return manifest.Source
+}
+
+// readStoredManifest reads the manifest of a stored archive, it returns nil for archives without manifest
+func readStoredManifest(b backend, name string) (*backupManifest, error) {
+	stream, err := b.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	reader, _, err := newDecompressReader(stream)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	tarReader := tar.NewReader(reader)
+	header, err := tarReader.Next()
+	if err != nil {
+		return nil, err
+	}
+	if !isManifest(header) {
+		return nil, nil
+	}
+	return readManifest(tarReader)
+}
+
+// backupPrefix returns the prefix of a backup name, empty if the name is not a prefix_20060102_150405 name
+func backupPrefix(name string) string {
+	if match := backupNamePattern.FindStringSubmatch(name); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+// filterPrefix returns the backups with the given prefix, all backups when the prefix is empty
+func filterPrefix(backups []backupFile, prefix string) []backupFile {
+	if prefix == "" {
+		return backups
+	}
+	var filtered []backupFile
+	for _, backup := range backups {
+		if backup.Prefix == prefix {
+			filtered = append(filtered, backup)
+		}
+	}
+	return filtered
+}
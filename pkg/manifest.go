@@ -0,0 +1,208 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"github.com/jkaninda/volume-backup/utils"
+	"io"
+	"os"
+	"time"
+)
+
+// manifestName is the name of the manifest members of backup archives
+const manifestName = "manifest.json"
+
+// paxManifestKey is the PAX record marking the manifest members,
+// a manifest.json file backed up from the volume is restored as any other file
+const paxManifestKey = "VOLUME-BACKUP.manifest"
+
+// The complete manifest, with the files, is the first member of the archives. Archives of older versions can start
+// with a manifest header, without the files, the complete manifest is then the last member.
+const (
+	manifestHeader   = "header"
+	manifestComplete = "1"
+)
+
+// manifestEntry describes an archived path, the checksum is only set for regular files
+type manifestEntry struct {
+	Path   string `json:"path"`
+	Type   string `json:"type"`
+	Size   int64  `json:"size"`
+	Mode   string `json:"mode"`
+	SHA256 string `json:"sha256,omitempty"`
+	Link   string `json:"link,omitempty"`
+}
+
+// backupManifest describes a backup archive and its files
+type backupManifest struct {
+	Source     string          `json:"source"`
+	SourceName string          `json:"sourceName,omitempty"`
+	Host       string          `json:"host"`
+	AppVersion string          `json:"appVersion"`
+	Codec      string          `json:"codec"`
+	Encryption string          `json:"encryption"`
+	StartTime  time.Time       `json:"startTime"`
+	EndTime    time.Time       `json:"endTime"`
+	Files      []manifestEntry `json:"files,omitempty"`
+}
+
+// newBackupManifest creates the manifest of a backup, files are added while they are archived
+func newBackupManifest(config *BackupConfig) *backupManifest {
+	host, err := os.Hostname()
+	if err != nil {
+		utils.Warn("Error reading hostname: %v", err)
+	}
+	source := config.sourcePath
+	if !config.fromFolder {
+		source = dataPath
+	}
+	return &backupManifest{
+		Source:     source,
+		SourceName: config.source,
+		Host:       host,
+		AppVersion: utils.AppVersion,
+		Codec:      config.compression.codec,
+		Encryption: config.encrypter.manifestMode(),
+		StartTime:  time.Now().UTC(),
+	}
+}
+
+// add records an archived path, sum is the SHA-256 of regular files content
+func (m *backupManifest) add(header *tar.Header, sum string) {
+	if m == nil {
+		return
+	}
+	m.Files = append(m.Files, manifestEntry{
+		Path:   header.Name,
+		Type:   entryType(header.Typeflag),
+		Size:   header.Size,
+		Mode:   fmt.Sprintf("%04o", header.Mode),
+		SHA256: sum,
+		Link:   header.Linkname,
+	})
+}
+
+// checksums returns the SHA-256 of the regular files, keyed by archive path
+func (m *backupManifest) checksums() map[string]string {
+	sums := make(map[string]string)
+	for _, entry := range m.Files {
+		if entry.SHA256 != "" {
+			sums[entry.Path] = entry.SHA256
+		}
+	}
+	return sums
+}
+
+// entryType returns the manifest type of a tar entry
+func entryType(typeflag byte) string {
+	switch typeflag {
+	case tar.TypeReg:
+		return "file"
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	case tar.TypeChar, tar.TypeBlock:
+		return "device"
+	case tar.TypeFifo:
+		return "fifo"
+	default:
+		return string(typeflag)
+	}
+}
+
+// isManifest reports whether a tar entry is a manifest member of the archive, the header or the complete manifest
+func isManifest(header *tar.Header) bool {
+	kind := header.PAXRecords[paxManifestKey]
+	return header.Name == manifestName && (kind == manifestHeader || kind == manifestComplete)
+}
+
+// isManifestHeader reports whether a manifest member is the manifest header, without the files
+func isManifestHeader(header *tar.Header) bool {
+	return header.PAXRecords[paxManifestKey] == manifestHeader
+}
+
+// readManifest reads the manifest member of an archive
+func readManifest(reader io.Reader) (*backupManifest, error) {
+	manifest := &backupManifest{}
+	if err := json.NewDecoder(reader).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("invalid backup manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// archiveWriter writes a backup archive to the temp directory, encrypted while it is written.
+// The complete manifest, with the checksums of the files, is the first member.
+type archiveWriter struct {
+	tar      *tar.Writer
+	file     io.WriteCloser
+	compress io.WriteCloser
+	manifest *backupManifest
+}
+
+// newArchiveWriter creates the archive file and writes the complete manifest
+func newArchiveWriter(fileName string, c compression, manifest *backupManifest, enc *encrypter) (*archiveWriter, error) {
+	file, err := createTempFile(enc.fileName(fileName), enc)
+	if err != nil {
+		return nil, err
+	}
+	w := &archiveWriter{file: file, manifest: manifest}
+	w.compress, err = newCompressWriter(file, c)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	w.tar = tar.NewWriter(w.compress)
+	if err := w.writeManifest(manifest); err != nil {
+		w.abort()
+		return nil, err
+	}
+	return w, nil
+}
+
+// writeManifest writes the complete manifest member
+func (w *archiveWriter) writeManifest(manifest *backupManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       manifestName,
+		Size:       int64(len(data)),
+		Mode:       0644,
+		ModTime:    time.Now().UTC(),
+		Format:     tar.FormatPAX,
+		PAXRecords: map[string]string{paxManifestKey: manifestComplete},
+	}
+	if err := w.tar.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = w.tar.Write(data)
+	return err
+}
+
+// close completes the archive
+func (w *archiveWriter) close() error {
+	if err := closeArchive(w.tar, w.compress); err != nil {
+		w.abort()
+		return err
+	}
+	utils.Info("Backup manifest: %d entries", len(w.manifest.Files))
+	return w.file.Close()
+}
+
+// abort closes the archive file after an error, the archive is incomplete
+func (w *archiveWriter) abort() {
+	_ = w.compress.Close()
+	_ = w.file.Close()
+}
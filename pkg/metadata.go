@@ -0,0 +1,104 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"archive/tar"
+	"github.com/jkaninda/volume-backup/utils"
+	"os"
+	"strings"
+	"time"
+)
+
+// paxXattrPrefix is the PAX record prefix of extended attributes, POSIX ACLs are stored as extended attributes
+const paxXattrPrefix = "SCHILY.xattr."
+
+// fileID identifies a file on a device, files with the same fileID are hard links
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// hardLinks maps the files with several links to the archive name of their first link
+type hardLinks map[fileID]string
+
+// fileHeader creates the tar header of a file, with its link target, owner, device numbers and extended attributes.
+// Hard links of an already archived file are stored as links to its first name.
+func fileHeader(path, name string, info os.FileInfo, links hardLinks) (*tar.Header, error) {
+	var linkTarget string
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		linkTarget = target
+	}
+	header, err := tar.FileInfoHeader(info, linkTarget)
+	if err != nil {
+		return nil, err
+	}
+	header.Name = name
+	// PAX format keeps sub-second modification times and extended attributes
+	header.Format = tar.FormatPAX
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
+
+	if info.Mode().IsRegular() && links != nil {
+		if id, ok := hardLinkID(info); ok {
+			if first, found := links[id]; found {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = first
+				header.Size = 0
+				return header, nil
+			}
+			links[id] = name
+		}
+	}
+	xattrs, err := readXattrs(path)
+	if err != nil {
+		utils.Warn("Error reading extended attributes of %s: %v", path, err)
+	}
+	for key, value := range xattrs {
+		if header.PAXRecords == nil {
+			header.PAXRecords = make(map[string]string)
+		}
+		header.PAXRecords[paxXattrPrefix+key] = value
+	}
+	return header, nil
+}
+
+// applyMetadata restores the owner, extended attributes, permissions and modification time of an extracted file.
+// The owner is only restored when running as root.
+func applyMetadata(path string, header *tar.Header) {
+	isSymlink := header.Typeflag == tar.TypeSymlink
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(path, header.Uid, header.Gid); err != nil {
+			utils.Warn("Error changing owner of %s: %v", path, err)
+		}
+	}
+	for key, value := range header.PAXRecords {
+		if !strings.HasPrefix(key, paxXattrPrefix) {
+			continue
+		}
+		if err := setXattr(path, strings.TrimPrefix(key, paxXattrPrefix), value); err != nil {
+			utils.Warn("Error setting extended attribute %s of %s: %v", strings.TrimPrefix(key, paxXattrPrefix), path, err)
+		}
+	}
+	if isSymlink {
+		if err := setSymlinkTimes(path, header.ModTime); err != nil {
+			utils.Warn("Error changing modification time of %s: %v", path, err)
+		}
+		return
+	}
+	// Permissions are changed after the owner, as changing the owner clears the setuid and setgid bits
+	if err := os.Chmod(path, header.FileInfo().Mode()); err != nil {
+		utils.Warn("Error changing permissions of %s: %v", path, err)
+	}
+	if err := os.Chtimes(path, header.ModTime, header.ModTime); err != nil {
+		utils.Warn("Error changing modification time of %s: %v", path, err)
+	}
+}
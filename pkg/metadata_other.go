@@ -0,0 +1,48 @@
+//go:build !linux
+
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"archive/tar"
+	"errors"
+	"os"
+	"time"
+)
+
+var errNotSupported = errors.New("not supported on this platform")
+
+// readXattrs returns the extended attributes of a file, they are only supported on Linux
+func readXattrs(path string) (map[string]string, error) {
+	return nil, nil
+}
+
+// setXattr sets an extended attribute of a file, they are only supported on Linux
+func setXattr(path, name, value string) error {
+	return errNotSupported
+}
+
+// makeSpecialFile creates a character device, a block device or a named pipe
+func makeSpecialFile(path string, header *tar.Header) error {
+	return errNotSupported
+}
+
+// setSymlinkTimes changes the modification time of a symlink itself
+func setSymlinkTimes(path string, modTime time.Time) error {
+	return nil
+}
+
+// fileInode returns the inode number of a file, 0 if not available
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
+
+// hardLinkID returns the identifier of a file, it reports false if the file has a single link
+func hardLinkID(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
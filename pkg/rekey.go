@@ -0,0 +1,400 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jkaninda/volume-backup/utils"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// rekeySuffix is appended to the name of a rekeyed file while it is uploaded and verified, it replaces the original once verified
+const rekeySuffix = ".rekey"
+
+// rekeyTarget is an encrypted file of a storage directory, split archives are read from their volumes
+type rekeyTarget struct {
+	name  string
+	split bool
+}
+
+// rekeySums are the hashes of a rekeyed file, before and after it is encrypted with the new keys
+type rekeySums struct {
+	content string
+	stored  contentDigest
+}
+
+// rekeyer re-encrypts the files of a storage directory. Signed files are checked while they are read,
+// and signed again once rekeyed, the signature covers the stored bytes.
+type rekeyer struct {
+	backend   backend
+	encrypter *encrypter
+	signer    *signer
+	verifier  *signatureVerifier
+}
+
+// StartRekey encrypts stored backups with new keys. Files are decrypted with the restore keys, the old ones.
+func StartRekey(cmd *cobra.Command) {
+	intro()
+	conf := initRekeyConfig(cmd)
+	err := runRekey(conf)
+	conf.encrypter.wipe()
+	conf.signer.wipe()
+	wipeRestoreKeys()
+	if err != nil {
+		utils.Fatal("%v", err)
+	}
+}
+
+// runRekey rekeys the selected files one by one, a failed file is left unchanged
+func runRekey(conf *RekeyConfig) error {
+	b, err := newBackend(conf.storage, conf.remotePath, conf.source)
+	if err != nil {
+		return fmt.Errorf("error creating %s storage: %w", conf.storage, err)
+	}
+	targets, err := selectRekeyFiles(conf, b)
+	if err != nil {
+		return fmt.Errorf("error selecting files to rekey: %w", err)
+	}
+	verifier, err := newSignatureVerifier(false)
+	if err != nil {
+		return fmt.Errorf("error loading signing keys: %w", err)
+	}
+	defer verifier.wipe()
+	r := &rekeyer{backend: b, encrypter: conf.encrypter, signer: conf.signer, verifier: verifier}
+	failed := 0
+	for i, target := range targets {
+		utils.Info("Rekeying %s (%d/%d) ...", target.name, i+1, len(targets))
+		err := r.rekey(target)
+		deleteTemp()
+		if err != nil {
+			failed++
+			utils.Error("Error rekeying %s: %v", target.name, err)
+			continue
+		}
+		utils.Info("%s rekeyed", target.name)
+	}
+	if failed > 0 {
+		utils.NotifyError(fmt.Sprintf("%d of %d file(s) could not be rekeyed", failed, len(targets)))
+		return fmt.Errorf("%d of %d file(s) could not be rekeyed", failed, len(targets))
+	}
+	utils.Info("%d file(s) rekeyed with %s encryption", len(targets), conf.encrypter.mode)
+	return nil
+}
+
+// selectRekeyFiles returns the encrypted files to rekey. A backup is rekeyed with its snapshot index. With --all,
+// every encrypted file of the prefix is rekeyed, including the snapshots, packs and index of the repository.
+func selectRekeyFiles(conf *RekeyConfig, b backend) ([]rekeyTarget, error) {
+	if conf.file != "" {
+		if encryptionExtension(conf.file) == "" {
+			return nil, fmt.Errorf("%s is not encrypted", conf.file)
+		}
+		if isRepositorySnapshot(conf.file) {
+			return nil, errors.New("the packs of a repository are shared by its snapshots, repositories are rekeyed with --all")
+		}
+	}
+	files, err := b.List()
+	if err != nil {
+		return nil, err
+	}
+	indexName := fmt.Sprintf("%s.%s", snapshotIndexName(conf.file), encryptionExtension(conf.file))
+	var targets []rekeyTarget
+	found := false
+	for _, file := range files {
+		target := rekeyTarget{name: file.name}
+		if strings.HasSuffix(file.name, ".parts.json") {
+			target = rekeyTarget{name: strings.TrimSuffix(file.name, ".parts.json"), split: true}
+		} else if partNamePattern.MatchString(file.name) {
+			continue
+		}
+		// Files left by an interrupted rekey have the .rekey extension, they are not selected
+		if encryptionExtension(target.name) == "" {
+			continue
+		}
+		switch {
+		case conf.file != "":
+			if target.name != conf.file && target.name != indexName {
+				continue
+			}
+			found = found || target.name == conf.file
+		case conf.prefix != "" && !strings.HasPrefix(target.name, conf.prefix+"_"):
+			continue
+		}
+		targets = append(targets, target)
+	}
+	if conf.file != "" && !found {
+		return nil, fmt.Errorf("backup %s not found", conf.file)
+	}
+	if len(targets) == 0 {
+		return nil, errors.New("no encrypted file found")
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].name < targets[j].name
+	})
+	return targets, nil
+}
+
+// rekey encrypts a stored file with the new keys. The new file is uploaded next to the original and read back,
+// it replaces the original only once verified. With another encryption, the file is renamed to its new extension and
+// the original is deleted, snapshot indexes and repository snapshots find it under its new name.
+func (r *rekeyer) rekey(target rekeyTarget) error {
+	name := r.encrypter.fileName(trimEncryptionExtension(target.name))
+	signature, err := r.signature(target.name)
+	if err != nil {
+		return err
+	}
+	var manifest *partsManifest
+	var stream io.ReadCloser
+	if target.split {
+		manifest, err = downloadPartsManifest(r.backend, target.name)
+		if err != nil {
+			return fmt.Errorf("error reading the volumes of %s: %w", target.name, err)
+		}
+		stream = newPartsReader(r.backend.Get, manifest)
+	} else {
+		stream, err = r.backend.Get(target.name)
+		if err != nil {
+			return err
+		}
+	}
+	staged := name + rekeySuffix
+	if target.split {
+		// The new volumes are never renamed, their names must differ from the volumes of the previous rekeys
+		staged = fmt.Sprintf("%s%s%d", name, rekeySuffix, time.Now().Unix())
+	}
+	stored := signature.reader(stream)
+	sums, err := r.reencrypt(target.name, stored, staged)
+	if err == nil {
+		// The original is checked against its signature before the rekeyed file replaces it
+		err = stored.finish()
+	}
+	stream.Close()
+	if err != nil {
+		return err
+	}
+	if target.split {
+		return r.replaceParts(manifest, name, staged, sums)
+	}
+	return r.replaceFile(target.name, name, staged, sums)
+}
+
+// reencrypt decrypts a stream with the old keys and encrypts it with the new keys to a file of the temp directory
+func (r *rekeyer) reencrypt(name string, stream io.Reader, staged string) (rekeySums, error) {
+	plain, err := decryptStream(name, stream)
+	if err != nil {
+		return rekeySums{}, err
+	}
+	out, err := os.Create(filepath.Join(tmpPath, staged))
+	if err != nil {
+		return rekeySums{}, err
+	}
+	defer out.Close()
+	contentHash, storedDigest := sha256.New(), newDigestWriter(out)
+	writer, err := r.encrypter.writer(storedDigest)
+	if err != nil {
+		return rekeySums{}, err
+	}
+	// Reading the decrypted stream until io.EOF checks the integrity of the original
+	if _, err := io.Copy(writer, io.TeeReader(plain, contentHash)); err != nil {
+		return rekeySums{}, fmt.Errorf("error decrypting %s: %w", name, err)
+	}
+	if err := writer.Close(); err != nil {
+		return rekeySums{}, err
+	}
+	if err := out.Close(); err != nil {
+		return rekeySums{}, err
+	}
+	return rekeySums{
+		content: hex.EncodeToString(contentHash.Sum(nil)),
+		stored:  storedDigest.digest(),
+	}, nil
+}
+
+// check reads back an uploaded file, it must be the written file. When the new keys can decrypt it, with a passphrase,
+// its decrypted content must also be the content of the original.
+func (r *rekeyer) check(stream io.Reader, sums rekeySums) error {
+	encryptedHash := sha256.New()
+	reader := io.TeeReader(stream, encryptedHash)
+	if r.encrypter.canDecrypt() {
+		plain, err := decryptReader(reader, nil, r.encrypter.passphrase)
+		if err != nil {
+			return err
+		}
+		contentHash := sha256.New()
+		if _, err := io.Copy(contentHash, plain); err != nil {
+			return err
+		}
+		if hex.EncodeToString(contentHash.Sum(nil)) != sums.content {
+			return errors.New("the decrypted content does not match the original")
+		}
+	}
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return err
+	}
+	if hex.EncodeToString(encryptedHash.Sum(nil)) != sums.stored.sha256 {
+		return errors.New("checksum mismatch, the uploaded file is corrupted")
+	}
+	return nil
+}
+
+// replaceFile uploads and verifies a rekeyed file, it is then renamed over the original, or to its new name
+func (r *rekeyer) replaceFile(original, name, staged string, sums rekeySums) error {
+	if err := r.backend.Put(staged); err != nil {
+		return fmt.Errorf("error uploading %s: %w", staged, err)
+	}
+	_ = os.Remove(filepath.Join(tmpPath, staged))
+	stream, err := r.backend.Get(staged)
+	if err == nil {
+		err = r.check(stream, sums)
+		stream.Close()
+	}
+	if err == nil {
+		err = r.stageSignature(name, sums.stored)
+	}
+	if err != nil {
+		_ = r.backend.Delete(staged)
+		return fmt.Errorf("verification of %s failed: %w", staged, err)
+	}
+	if err := r.backend.Rename(staged, name); err != nil {
+		return err
+	}
+	if err := r.switchSignature(name); err != nil {
+		return err
+	}
+	return r.deleteRenamed(original, name, original)
+}
+
+// replaceParts uploads and verifies the volumes of a rekeyed split archive. The volumes keep their staged names,
+// the archive switches to them when the new manifest is renamed over the original one, or to its new name.
+// The original volumes are deleted afterwards, an interrupted rekey leaves a readable archive.
+func (r *rekeyer) replaceParts(original *partsManifest, name, staged string, sums rekeySums) error {
+	if err := uploadParts(r.backend, staged, original.PartSize); err != nil {
+		return fmt.Errorf("error uploading %s: %w", staged, err)
+	}
+	manifest, err := downloadPartsManifest(r.backend, staged)
+	if err == nil {
+		reader := newPartsReader(r.backend.Get, manifest)
+		err = r.check(reader, sums)
+		reader.Close()
+	}
+	if err == nil {
+		manifest.Archive = name
+		err = r.stageManifest(manifest)
+	}
+	if err == nil {
+		err = r.stageSignature(name, sums.stored)
+	}
+	if err != nil {
+		if manifest != nil {
+			for _, part := range manifest.Parts {
+				_ = r.backend.Delete(part.Name)
+			}
+		}
+		_ = r.backend.Delete(partsManifestName(staged))
+		return fmt.Errorf("verification of %s failed: %w", staged, err)
+	}
+	manifestName := partsManifestName(name)
+	if err := r.backend.Rename(manifestName+rekeySuffix, manifestName); err != nil {
+		return fmt.Errorf("error renaming %s: %w", manifestName+rekeySuffix, err)
+	}
+	if err := r.switchSignature(name); err != nil {
+		return err
+	}
+	if err := r.deleteRenamed(original.Archive, name, partsManifestName(original.Archive)); err != nil {
+		return err
+	}
+	for _, part := range original.Parts {
+		if err := r.backend.Delete(part.Name); err != nil {
+			utils.Warn("Error deleting volume %s: %v", part.Name, err)
+		}
+	}
+	return r.backend.Delete(partsManifestName(staged))
+}
+
+// deleteRenamed deletes the original file of a file rekeyed to another encryption, and its signature,
+// once the file is stored under its new name. stored is the original file, or the manifest of a split archive.
+func (r *rekeyer) deleteRenamed(original, name, stored string) error {
+	if original == name {
+		return nil
+	}
+	utils.Info("%s renamed to %s", original, name)
+	if err := r.backend.Delete(stored); err != nil {
+		return fmt.Errorf("error deleting %s: %w", stored, err)
+	}
+	if _, err := r.backend.Stat(signatureName(original)); err == nil {
+		return r.backend.Delete(signatureName(original))
+	}
+	return nil
+}
+
+// signature returns the signature of a stored file, checked with the signing keys. Unsigned files are not checked,
+// a signed file is only rekeyed when it can be signed again.
+func (r *rekeyer) signature(name string) (*fileSignature, error) {
+	if _, err := r.backend.Stat(signatureName(name)); err != nil {
+		return nil, nil
+	}
+	if r.signer == nil {
+		return nil, fmt.Errorf("%s is signed, SIGNING_KEY_FILE or SIGNING_HMAC_KEY is required to sign it again", name)
+	}
+	return r.verifier.fetch(r.backend, name)
+}
+
+// stageSignature uploads the signature of a rekeyed file next to the original signature, nothing is signed without a signer
+func (r *rekeyer) stageSignature(name string, digest contentDigest) error {
+	if r.signer == nil {
+		return nil
+	}
+	return putSignature(r.backend, r.signer, name, signatureName(name)+rekeySuffix, digest)
+}
+
+// switchSignature renames the signature of a rekeyed file over the original signature, once the file is replaced
+func (r *rekeyer) switchSignature(name string) error {
+	if r.signer == nil {
+		return nil
+	}
+	return r.backend.Rename(signatureName(name)+rekeySuffix, signatureName(name))
+}
+
+// stageManifest uploads the manifest of the rekeyed volumes next to the original manifest, and reads it back
+func (r *rekeyer) stageManifest(manifest *partsManifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	name := partsManifestName(manifest.Archive) + rekeySuffix
+	if err := os.WriteFile(filepath.Join(tmpPath, name), data, 0600); err != nil {
+		return err
+	}
+	defer os.Remove(filepath.Join(tmpPath, name))
+	if err := r.backend.Put(name); err != nil {
+		return fmt.Errorf("error uploading %s: %w", name, err)
+	}
+	stream, err := r.backend.Get(name)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	stored, err := io.ReadAll(stream)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(stored, data) {
+		_ = r.backend.Delete(name)
+		return fmt.Errorf("%s is corrupted", name)
+	}
+	return nil
+}
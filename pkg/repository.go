@@ -0,0 +1,723 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/jkaninda/volume-backup/utils"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	formatArchive    = "archive"
+	formatRepository = "repository"
+
+	repositoryVersion = 1
+	// packTargetSize is the size a pack is uploaded at
+	packTargetSize = 16 * 1024 * 1024
+	snapshotSuffix = ".snapshot.json"
+)
+
+// chunkLocation is the location of a compressed chunk inside a pack
+type chunkLocation struct {
+	Pack   string `json:"pack"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	Size   int64  `json:"size"`
+}
+
+// repositoryIndex lists all the chunks stored in the repository, it is used to deduplicate chunks.
+// Snapshots carry the location of their own chunks, the index can be rebuilt without breaking restores.
+type repositoryIndex struct {
+	Version int                      `json:"version"`
+	Chunks  map[string]chunkLocation `json:"chunks"`
+}
+
+// repositoryNode is a file, directory, symlink, hard link or special file of a repository snapshot
+type repositoryNode struct {
+	Path     string            `json:"path"`
+	Type     string            `json:"type"`
+	Mode     int64             `json:"mode"`
+	Uid      int               `json:"uid"`
+	Gid      int               `json:"gid"`
+	ModTime  int64             `json:"mtime"`
+	Size     int64             `json:"size,omitempty"`
+	Linkname string            `json:"linkname,omitempty"`
+	Devmajor int64             `json:"devmajor,omitempty"`
+	Devminor int64             `json:"devminor,omitempty"`
+	Xattrs   map[string][]byte `json:"xattrs,omitempty"`
+	Chunks   []string          `json:"chunks,omitempty"`
+}
+
+// header returns the tar header holding the metadata of the node
+func (n repositoryNode) header() *tar.Header {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     n.Path,
+		Linkname: n.Linkname,
+		Mode:     n.Mode,
+		Uid:      n.Uid,
+		Gid:      n.Gid,
+		ModTime:  time.Unix(0, n.ModTime),
+		Devmajor: n.Devmajor,
+		Devminor: n.Devminor,
+	}
+	switch n.Type {
+	case "dir":
+		header.Typeflag = tar.TypeDir
+	case "symlink":
+		header.Typeflag = tar.TypeSymlink
+	case "hardlink":
+		header.Typeflag = tar.TypeLink
+	case "char":
+		header.Typeflag = tar.TypeChar
+	case "block":
+		header.Typeflag = tar.TypeBlock
+	case "fifo":
+		header.Typeflag = tar.TypeFifo
+	}
+	for key, value := range n.Xattrs {
+		if header.PAXRecords == nil {
+			header.PAXRecords = make(map[string]string)
+		}
+		header.PAXRecords[paxXattrPrefix+key] = string(value)
+	}
+	return header
+}
+
+// repositorySnapshot describes the volume at the time of a backup, and where its chunks are stored
+type repositorySnapshot struct {
+	Version   int                      `json:"version"`
+	CreatedAt time.Time                `json:"createdAt"`
+	Nodes     []repositoryNode         `json:"nodes"`
+	Chunks    map[string]chunkLocation `json:"chunks"`
+}
+
+// repository writes deduplicated chunks into packs, the packs are uploaded to the repository of every storage
+type repository struct {
+	prefix    string
+	encrypter *encrypter
+	stores    []*repositoryStore
+	pack      bytes.Buffer
+	pending   map[string]chunkLocation
+	// Statistics
+	chunks    int
+	newChunks int
+	packsSize int64
+}
+
+// repositoryStore is the repository of a storage, its index lists the chunks already stored on it
+type repositoryStore struct {
+	dest  *destination
+	index *repositoryIndex
+	// state is the local copy of the index
+	state string
+}
+
+// active returns the storages no upload failed to
+func (r *repository) active() []*repositoryStore {
+	var stores []*repositoryStore
+	for _, store := range r.stores {
+		if store.dest.err == nil {
+			stores = append(stores, store)
+		}
+	}
+	return stores
+}
+
+// Put uploads a file of the temp directory to the repository of every active storage
+func (r *repository) Put(name string) error {
+	var dests destinations
+	for _, store := range r.active() {
+		dests = append(dests, store.dest)
+	}
+	return dests.Put(name)
+}
+
+// isRepositorySnapshot reports whether a file is a repository snapshot
+func isRepositorySnapshot(file string) bool {
+	return strings.HasSuffix(trimEncryptionExtension(file), snapshotSuffix)
+}
+
+// isRepositoryFile reports whether a stored file belongs to a repository: a pack, an index, a snapshot or its signature.
+// Snapshots reference the packs of older backups, repository files are never pruned with the archives.
+func isRepositoryFile(name string) bool {
+	name = trimEncryptionExtension(strings.TrimSuffix(name, ".sig"))
+	return strings.HasSuffix(name, snapshotSuffix) || strings.HasSuffix(name, "_repository.index.json") ||
+		(strings.HasSuffix(name, ".pack") && strings.Contains(name, "_pack_"))
+}
+
+// repositoryIndexName returns the name of the index of a repository, before it is encrypted
+func repositoryIndexName(prefix string) string {
+	return fmt.Sprintf("%s_repository.index.json", prefix)
+}
+
+// repositoryStateFile returns the local copy of the repository index, kept when the index cannot be decrypted by the backup.
+// With several storages, each one has its own copy.
+func repositoryStateFile(prefix, storage string) string {
+	if storage != "" {
+		return filepath.Join(snapshotPath, fmt.Sprintf("%s_repository.%s.index.json", prefix, storage))
+	}
+	return filepath.Join(snapshotPath, repositoryIndexName(prefix))
+}
+
+// loadRepositoryIndex downloads the index of the repository of a storage, a new index is created if none is found.
+// With public key encryption, the index is read from its local copy.
+func loadRepositoryIndex(prefix string, enc *encrypter, d *destination, state string) (*repositoryIndex, error) {
+	index := &repositoryIndex{Version: repositoryVersion, Chunks: make(map[string]chunkLocation)}
+	name := enc.fileName(repositoryIndexName(prefix))
+	var data []byte
+	if enc.canDecrypt() {
+		if err := download(d.backend, name); err != nil {
+			utils.Warn("Repository index %s not found on %s storage, creating a new repository index", name, d.storage)
+			return index, nil
+		}
+		var err error
+		data, err = readTempFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("error reading repository index %s: %w", name, err)
+		}
+	} else {
+		// Snapshots carry the location of their chunks, a new index only uploads the chunks again
+		name = state
+		var err error
+		data, err = os.ReadFile(name)
+		if err != nil {
+			utils.Warn("Repository index %s not found, creating a new repository index", name)
+			return index, nil
+		}
+	}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("invalid repository index %s: %w", name, err)
+	}
+	if index.Chunks == nil {
+		index.Chunks = make(map[string]chunkLocation)
+	}
+	utils.Info("Repository index of %s storage loaded, %d chunks", d.storage, len(index.Chunks))
+	return index, nil
+}
+
+// addChunk stores a chunk if it is not already in the repository, and returns its hash
+func (r *repository) addChunk(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	r.chunks++
+	if r.stored(hash) {
+		return hash, nil
+	}
+	if _, ok := r.pending[hash]; ok {
+		return hash, nil
+	}
+	offset := int64(r.pack.Len())
+	gzWriter := gzip.NewWriter(&r.pack)
+	if _, err := gzWriter.Write(data); err != nil {
+		return "", err
+	}
+	if err := gzWriter.Close(); err != nil {
+		return "", err
+	}
+	r.pending[hash] = chunkLocation{
+		Offset: offset,
+		Length: int64(r.pack.Len()) - offset,
+		Size:   int64(len(data)),
+	}
+	r.newChunks++
+	if r.pack.Len() >= packTargetSize {
+		return hash, r.flushPack()
+	}
+	return hash, nil
+}
+
+// stored reports whether a chunk is already in the repository of every active storage.
+// A chunk missing from one of them is packed again, the packs are the same on every storage.
+func (r *repository) stored(hash string) bool {
+	for _, store := range r.active() {
+		if _, ok := store.index.Chunks[hash]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// flushPack uploads the current pack and adds its chunks to the indexes missing them
+func (r *repository) flushPack() error {
+	if r.pack.Len() == 0 {
+		return nil
+	}
+	sum := sha256.Sum256(r.pack.Bytes())
+	name := fmt.Sprintf("%s_pack_%s.pack", r.prefix, hex.EncodeToString(sum[:]))
+	name, size, err := writeRepositoryFile(r, r.encrypter, nil, name, r.pack.Bytes())
+	if err != nil {
+		return err
+	}
+	r.packsSize += size
+	for _, store := range r.active() {
+		for hash, location := range r.pending {
+			if _, ok := store.index.Chunks[hash]; !ok {
+				location.Pack = name
+				store.index.Chunks[hash] = location
+			}
+		}
+	}
+	r.pending = make(map[string]chunkLocation)
+	r.pack.Reset()
+	return nil
+}
+
+// writeRepositoryFile encrypts and uploads a repository file, and returns its final name and its uploaded size.
+// The stored file is signed when a signer is set.
+func writeRepositoryFile(u uploader, enc *encrypter, s *signer, name string, data []byte) (string, int64, error) {
+	err := os.WriteFile(filepath.Join(tmpPath, name), data, 0600)
+	if err != nil {
+		return "", 0, err
+	}
+	if enc != nil {
+		encryptBackup(name, enc)
+		name = enc.fileName(name)
+	}
+	defer os.Remove(filepath.Join(tmpPath, name))
+	var size int64
+	if fileInfo, err := os.Stat(filepath.Join(tmpPath, name)); err == nil {
+		size = fileInfo.Size()
+	}
+	err = u.Put(name)
+	if err != nil {
+		return "", 0, fmt.Errorf("error uploading %s: %w", name, err)
+	}
+	if err := uploadSignature(u, s, name); err != nil {
+		return "", 0, fmt.Errorf("error signing %s: %w", name, err)
+	}
+	return name, size, nil
+}
+
+// addTree chunks the files of a folder selected by the filter and returns the snapshot nodes.
+// Hard links are stored as links to the first path of the file, their content is only chunked once.
+func (r *repository) addTree(sourceFolder string, filter *pathFilter) ([]repositoryNode, error) {
+	var nodes []repositoryNode
+	c := newChunker(nil)
+	links := make(hardLinks)
+	err := walkFiltered(sourceFolder, filter, func(path, relPath string, info os.FileInfo) error {
+		if info.Mode()&os.ModeSocket != 0 {
+			utils.Warn("Skipping socket %s", relPath)
+			return nil
+		}
+		header, err := fileHeader(path, filepath.ToSlash(relPath), info, links)
+		if err != nil {
+			return err
+		}
+		node := repositoryNode{
+			Path:     header.Name,
+			Mode:     header.Mode,
+			Uid:      header.Uid,
+			Gid:      header.Gid,
+			ModTime:  header.ModTime.UnixNano(),
+			Linkname: header.Linkname,
+		}
+		for key, value := range header.PAXRecords {
+			if strings.HasPrefix(key, paxXattrPrefix) {
+				if node.Xattrs == nil {
+					node.Xattrs = make(map[string][]byte)
+				}
+				node.Xattrs[strings.TrimPrefix(key, paxXattrPrefix)] = []byte(value)
+			}
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			node.Type = "dir"
+		case tar.TypeSymlink:
+			node.Type = "symlink"
+		case tar.TypeLink:
+			node.Type = "hardlink"
+		case tar.TypeChar, tar.TypeBlock:
+			node.Type = "char"
+			if header.Typeflag == tar.TypeBlock {
+				node.Type = "block"
+			}
+			node.Devmajor, node.Devminor = header.Devmajor, header.Devminor
+		case tar.TypeFifo:
+			node.Type = "fifo"
+		case tar.TypeReg:
+			node.Type = "file"
+			node.Size, node.Chunks, err = r.addFile(c, path)
+			if err != nil {
+				if os.IsNotExist(err) {
+					utils.Warn("%s has been removed during backup, skipping", path)
+					return nil
+				}
+				return err
+			}
+		default:
+			utils.Warn("Skipping unsupported file type: %s in file %s", info.Mode().Type(), relPath)
+			return nil
+		}
+		nodes = append(nodes, node)
+		return nil
+	})
+	return nodes, err
+}
+
+// addFile chunks a file and returns its size and the hashes of its chunks
+func (r *repository) addFile(c *chunker, path string) (int64, []string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer file.Close()
+	c.reset(file)
+	var size int64
+	var chunks []string
+	for {
+		data, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		hash, err := r.addChunk(data)
+		if err != nil {
+			return 0, nil, err
+		}
+		size += int64(len(data))
+		chunks = append(chunks, hash)
+	}
+	return size, chunks, nil
+}
+
+// repositoryBackups backs up the volume into the repository of every storage. The volume is read and chunked once,
+// each storage has its own repository index and snapshot, the packs are uploaded to every storage in parallel.
+func repositoryBackups(config *BackupConfig, dests destinations) error {
+	utils.Info("Backup data to %s storage, repository format", storagesName(config.storages))
+	startTime = time.Now().Format(utils.TimeFormat())
+	defer deleteTemp()
+	sourceFolder := config.sourcePath
+	if config.consistent {
+		utils.Info("Consistent mode enabled, copying data to %s ...", dataTmpPath)
+		err := utils.CopyDir(config.sourcePath, dataTmpPath)
+		defer deleteDataTemp()
+		if err != nil {
+			err = fmt.Errorf("error copying data to %s: %w", dataTmpPath, err)
+			dests.fail(err)
+			_ = dests.report(config, startTime)
+			return err
+		}
+		sourceFolder = dataTmpPath
+	}
+	repo := &repository{prefix: config.prefix, encrypter: config.encrypter, pending: make(map[string]chunkLocation)}
+	for _, d := range dests.active() {
+		// The local copy of an index only lists the chunks of its storage
+		state := repositoryStateFile(config.prefix, "")
+		if len(dests) > 1 {
+			state = repositoryStateFile(config.prefix, d.storage)
+		}
+		index, err := loadRepositoryIndex(config.prefix, config.encrypter, d, state)
+		if err != nil {
+			d.err = err
+			utils.Error("Error loading the repository of %s storage: %v", d.storage, err)
+			continue
+		}
+		repo.stores = append(repo.stores, &repositoryStore{dest: d, index: index, state: state})
+	}
+	nodes, err := repo.addTree(sourceFolder, config.filter)
+	if err == nil {
+		err = repo.flushPack()
+	}
+	if err != nil {
+		for _, store := range repo.active() {
+			store.dest.err = fmt.Errorf("error creating snapshot: %w", err)
+		}
+	}
+	utils.Info("%d chunks, %d new chunks, %d bytes of packs uploaded", repo.chunks, repo.newChunks, repo.packsSize)
+	// The snapshot has the same name on every storage
+	snapshotName := fmt.Sprintf("%s_%s%s", config.prefix, time.Now().Format("20060102_150405"), snapshotSuffix)
+	for _, store := range repo.active() {
+		d := store.dest
+		var size int64
+		d.file, size, d.err = repositorySnapshotBackup(config, store, snapshotName, nodes)
+		d.size = repo.packsSize + size
+		if d.err != nil {
+			utils.Error("Error uploading backup to %s storage: %v", d.storage, d.err)
+		}
+	}
+	if config.prune {
+		utils.Warn("Pruning is not supported for the repository format")
+	}
+	//Send notifications
+	return dests.report(config, startTime)
+}
+
+// repositorySnapshotBackup uploads the snapshot and the index of the repository of a storage,
+// it returns the snapshot name and the uploaded size. The snapshot lists the chunk locations of its storage.
+func repositorySnapshotBackup(config *BackupConfig, store *repositoryStore, name string, nodes []repositoryNode) (string, int64, error) {
+	b := store.dest.backend
+	snapshot := repositorySnapshot{
+		Version:   repositoryVersion,
+		CreatedAt: time.Now(),
+		Nodes:     nodes,
+		Chunks:    make(map[string]chunkLocation),
+	}
+	for _, node := range nodes {
+		for _, hash := range node.Chunks {
+			snapshot.Chunks[hash] = store.index.Chunks[hash]
+		}
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return "", 0, fmt.Errorf("error creating snapshot: %w", err)
+	}
+	// Chunks are checked against their hash, the snapshot listing them is signed
+	snapshotName, snapshotSize, err := writeRepositoryFile(b, config.encrypter, config.signer, name, data)
+	if err != nil {
+		return "", 0, fmt.Errorf("error uploading snapshot: %w", err)
+	}
+	data, err = json.Marshal(store.index)
+	if err != nil {
+		return "", 0, fmt.Errorf("error creating repository index: %w", err)
+	}
+	_, indexSize, err := writeRepositoryFile(b, config.encrypter, nil, repositoryIndexName(config.prefix), data)
+	if err != nil {
+		return "", 0, fmt.Errorf("error uploading repository index: %w", err)
+	}
+	if !config.encrypter.canDecrypt() {
+		if err := saveRepositoryState(store.state, data); err != nil {
+			utils.Error("Error saving repository index, next backup will upload all chunks again: %v", err)
+		}
+	}
+	utils.Info("Snapshot %s uploaded to %s storage", snapshotName, store.dest.storage)
+	return snapshotName, snapshotSize + indexSize, nil
+}
+
+// saveRepositoryState keeps a local copy of the repository index
+func saveRepositoryState(state string, data []byte) error {
+	err := os.MkdirAll(snapshotPath, 0700)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(state, data, 0600)
+}
+
+// restoreRepository restores a repository snapshot
+func restoreRepository(b backend, file string, opts restoreOptions) {
+	utils.Info("Restoring repository snapshot %s ...", file)
+	copyFromStorage(b, file)
+	if err := opts.verifier.checkTempFile(b, file); err != nil {
+		utils.Fatal("Error checking the signature of %s: %v", file, err)
+	}
+	data, err := readTempFile(file)
+	if err != nil {
+		utils.Fatal("Error reading snapshot %s: %v", file, err)
+	}
+	snapshot := &repositorySnapshot{}
+	if err = json.Unmarshal(data, snapshot); err != nil {
+		utils.Fatal("Invalid snapshot %s: %v", file, err)
+	}
+	if snapshot.Version > repositoryVersion {
+		utils.Fatal("Snapshot version %d is not supported, please upgrade", snapshot.Version)
+	}
+	// targets lists where each chunk has to be written
+	type target struct {
+		path   string
+		offset int64
+	}
+	targets := make(map[string][]target)
+	packs := make(map[string][]string)
+	// Paths, link targets and sizes are checked like archive entries
+	e := newExtractor(opts)
+	restored := make([]repositoryNode, 0, len(snapshot.Nodes))
+	for _, node := range snapshot.Nodes {
+		if !e.selected(node.Path, node.Type == "dir") {
+			continue
+		}
+		path, err := e.safePath(node.Path)
+		if err != nil {
+			e.reject(node.Path, err.Error())
+			continue
+		}
+		if node.Type != "dir" && path == e.root {
+			e.reject(node.Path, "invalid file name")
+			continue
+		}
+		if e.plan != nil {
+			if err := e.planNode(node, path); err != nil {
+				utils.Fatal("Error comparing %s: %v", node.Path, err)
+			}
+			continue
+		}
+		switch node.Type {
+		case "dir":
+			err = os.MkdirAll(path, 0755)
+		case "symlink":
+			if err := e.checkSymlink(path, node.Linkname); err != nil {
+				e.reject(node.Path, err.Error())
+				continue
+			}
+			err = os.MkdirAll(filepath.Dir(path), 0755)
+			if err == nil {
+				err = replaceFile(path, func() error {
+					return os.Symlink(node.Linkname, path)
+				})
+				e.symlinks = append(e.symlinks, path)
+			}
+		case "file":
+			ok, sizeErr := e.checkSize(node.Path, node.Size)
+			if sizeErr != nil {
+				utils.Fatal("Error restoring %s: %v", node.Path, sizeErr)
+			}
+			if !ok {
+				continue
+			}
+			err = createSizedFile(path, node.Size)
+			var offset int64
+			for _, hash := range node.Chunks {
+				location, ok := snapshot.Chunks[hash]
+				if !ok {
+					utils.Fatal("Chunk %s of %s not found in snapshot", hash, node.Path)
+				}
+				if len(targets[hash]) == 0 {
+					packs[location.Pack] = append(packs[location.Pack], hash)
+				}
+				targets[hash] = append(targets[hash], target{path: path, offset: offset})
+				offset += location.Size
+			}
+		case "hardlink", "char", "block", "fifo":
+			// Hard links and special files are created like archive entries, with their metadata
+			if err := e.extractEntry(nil, node.header()); err != nil {
+				utils.Fatal("Error restoring %s: %v", node.Path, err)
+			}
+			continue
+		default:
+			e.reject(node.Path, fmt.Sprintf("unsupported node type %s", node.Type))
+			continue
+		}
+		if err != nil {
+			utils.Fatal("Error restoring %s: %v", node.Path, err)
+		}
+		restored = append(restored, node)
+	}
+	if e.plan != nil {
+		e.summary()
+		deleteTemp()
+		return
+	}
+	e.restored += len(restored)
+	// Symlinks redirected by other nodes are removed before any content is written
+	if err := e.finish(); err != nil {
+		utils.Fatal("Error restoring snapshot: %v", err)
+	}
+	// Packs are downloaded one by one, their chunks are written where they belong
+	packNames := make([]string, 0, len(packs))
+	for pack := range packs {
+		packNames = append(packNames, pack)
+	}
+	sort.Strings(packNames)
+	for i, name := range packNames {
+		utils.Info("Restoring pack %d/%d ...", i+1, len(packNames))
+		// Packs rekeyed with another encryption are renamed, the snapshot keeps their original names
+		pack := resolveName(b, name)
+		copyFromStorage(b, pack)
+		data, err := readTempFile(pack)
+		if err != nil {
+			utils.Fatal("Error reading pack %s: %v", pack, err)
+		}
+		for _, hash := range packs[name] {
+			chunk, err := readChunk(data, hash, snapshot.Chunks[hash])
+			if err != nil {
+				utils.Fatal("Error reading chunk %s from %s: %v", hash, pack, err)
+			}
+			for _, t := range targets[hash] {
+				if err := writeChunk(t.path, t.offset, chunk); err != nil {
+					utils.Fatal("Error writing %s: %v", t.path, err)
+				}
+			}
+		}
+		_ = os.Remove(filepath.Join(tmpPath, pack))
+		_ = os.Remove(RemoveLastExtension(filepath.Join(tmpPath, pack)))
+	}
+	// Owners, permissions and modification times are set once all the content is written,
+	// directories last so that their modification time is kept
+	for i := len(restored) - 1; i >= 0; i-- {
+		node := restored[i]
+		path, err := e.safePath(node.Path)
+		if err != nil {
+			continue
+		}
+		if info, err := os.Lstat(path); err != nil || (node.Type == "symlink") != (info.Mode()&os.ModeSymlink != 0) {
+			// Removed symlink escaping the data path
+			continue
+		}
+		applyMetadata(path, node.header())
+	}
+	e.summary()
+	utils.Info("Backup has been restored.")
+	deleteTemp()
+}
+
+// readChunk extracts a chunk from a pack and checks its hash
+func readChunk(pack []byte, hash string, location chunkLocation) ([]byte, error) {
+	if location.Offset < 0 || location.Offset+location.Length > int64(len(pack)) {
+		return nil, fmt.Errorf("chunk is out of the pack bounds")
+	}
+	gzReader, err := gzip.NewReader(bytes.NewReader(pack[location.Offset : location.Offset+location.Length]))
+	if err != nil {
+		return nil, err
+	}
+	defer gzReader.Close()
+	chunk, err := io.ReadAll(io.LimitReader(gzReader, location.Size+1))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(chunk)
+	if hex.EncodeToString(sum[:]) != hash || int64(len(chunk)) != location.Size {
+		return nil, fmt.Errorf("chunk checksum mismatch")
+	}
+	return chunk, nil
+}
+
+// createSizedFile creates an empty file of the given size, chunks are written into it afterward
+func createSizedFile(path string, size int64) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	var file *os.File
+	err := replaceFile(path, func() error {
+		var err error
+		file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err = file.Truncate(size); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// writeChunk writes a chunk at the given offset of a file
+func writeChunk(path string, offset int64, chunk []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err = file.WriteAt(chunk, offset); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -7,296 +7,162 @@
 package pkg
 
 import (
-	"archive/tar"
-	"compress/gzip"
 	"fmt"
-	"github.com/jkaninda/encryptor"
-	"github.com/jkaninda/go-storage/pkg/ftp"
-	"github.com/jkaninda/go-storage/pkg/local"
-	"github.com/jkaninda/go-storage/pkg/s3"
-	"github.com/jkaninda/go-storage/pkg/ssh"
 	"github.com/jkaninda/volume-backup/utils"
 	"github.com/spf13/cobra"
 	"io"
-	"os"
-	"path/filepath"
 )
 
 func StartRestore(cmd *cobra.Command) {
-	intro()
 	restoreConf := initRestoreConfig(cmd)
-
-	switch restoreConf.storage {
-	case "s3":
-		restoreFromS3(restoreConf.file, restoreConf.bucket, restoreConf.s3Path)
-	case "local":
-		localRestore(restoreConf.file)
-	case "ssh":
-		restoreFromRemote(restoreConf.file, restoreConf.remotePath)
-	case "ftp":
-		restoreFromFTP(restoreConf.file, restoreConf.remotePath)
-	default:
-		localRestore(restoreConf.file)
-
-	}
-}
-
-func localRestore(file string) {
-	utils.Info("Restore data from local")
-	localStorage := local.NewStorage(local.Config{
-		LocalPath:  tmpPath,
-		RemotePath: backupDestination,
-	})
-	err := localStorage.CopyFrom(file)
+	intro()
+	verifier, err := newSignatureVerifier(restoreConf.allowUnsigned)
 	if err != nil {
-		utils.Fatal("Error copying file, error %v", err)
+		utils.Fatal("Error loading signing keys: %v", err)
 	}
-	RestoreData(file)
-
-}
-func restoreFromS3(file, bucket, s3Path string) {
-	utils.Info("Restore data from s3")
-	awsConfig := initAWSConfig()
-	s3Storage, err := s3.NewStorage(s3.Config{
-		Endpoint:       awsConfig.endpoint,
-		Bucket:         awsConfig.bucket,
-		AccessKey:      awsConfig.accessKey,
-		SecretKey:      awsConfig.secretKey,
-		Region:         awsConfig.region,
-		DisableSsl:     awsConfig.disableSsl,
-		ForcePathStyle: awsConfig.forcePathStyle,
-		RemotePath:     awsConfig.remotePath,
-		LocalPath:      tmpPath,
-	})
-	if err != nil {
-		utils.Fatal("Error creating s3 storage: %s", err)
+	restoreConf.verifier = verifier
+	b := openBackend(restoreConf.storage, restoreConf.remotePath, restoreConf.source)
+	if restoreConf.latest || !restoreConf.before.IsZero() {
+		file, err := resolveRestoreFile(restoreConf, b)
+		if err != nil {
+			utils.Fatal("Error resolving the backup to restore: %v", err)
+		}
+		utils.Info("Restoring backup %s", file)
+		restoreConf.file = file
+	}
+	if restoreConf.dryRun {
+		// Nothing is written to the target, the backup entries are compared with its files
+		if restoreConf.strategy == strategyFailIfNotEmpty {
+			if err := checkEmptyTarget(restoreConf.root); err != nil {
+				utils.Fatal("Restore would fail: %v", err)
+			}
+		}
+		restoreConf.plan = newRestorePlan(restoreConf.root, restoreConf.strategy)
+		utils.Info("Dry run restore to %s, strategy: %s", restoreConf.root, restoreConf.strategy)
+	} else {
+		staging, err := prepareRestore(restoreConf)
+		if err != nil {
+			utils.Fatal("Error preparing restore to %s: %v", restoreConf.root, err)
+		}
+		restoreConf.staging = staging
+		utils.Info("Restoring to %s, strategy: %s", restoreConf.root, restoreConf.strategy)
+	}
+
+	utils.Info("Restore data from %s storage", restoreConf.storage)
+	restoreChain(b, restoreConf.file, restoreConf.options())
+	// Archives are streamed, only the indexes and repository files are downloaded to the temp directory
+	deleteTemp()
+	wipeRestoreKeys()
+	restoreConf.verifier.wipe()
+	if restoreConf.dryRun {
+		if err := restoreConf.plan.finish(); err != nil {
+			utils.Fatal("Error reading %s: %v", restoreConf.root, err)
+		}
+		if err := restoreConf.plan.print(restoreConf.output); err != nil {
+			utils.Fatal("Error writing the restore plan: %v", err)
+		}
+		return
 	}
-	err = s3Storage.CopyFrom(file)
-	if err != nil {
-		utils.Fatal("Error copying file, error %v", err)
+	// The target is only changed once the whole backup has been extracted
+	if err := commitRestore(restoreConf); err != nil {
+		utils.Fatal("Error moving restored files to %s: %v", restoreConf.root, err)
 	}
-	RestoreData(file)
+	utils.Info("Restore to %s completed", restoreConf.root)
 }
-func restoreFromRemote(file, remotePath string) {
-	utils.Info("Restore data from remote server")
-	sshConfig, err := loadSSHConfig()
+
+// resolveRestoreFile returns the latest backup of the storage, or the latest one created before the --before time.
+// Backups are selected by BACKUP_PREFIX when it is set.
+func resolveRestoreFile(conf *RestoreConfig, b backend) (string, error) {
+	backups, err := listBackups(b)
 	if err != nil {
-		utils.Fatal("Error loading ssh config: %s", err)
+		return "", err
 	}
-	sshStorage, err := ssh.NewStorage(ssh.Config{
-		Host:         sshConfig.hostName,
-		Port:         sshConfig.port,
-		User:         sshConfig.user,
-		Password:     sshConfig.password,
-		IdentifyFile: sshConfig.identifyFile,
-		RemotePath:   remotePath,
-		LocalPath:    tmpPath,
-	})
-	if err != nil {
-		utils.Fatal("Error creating s3 storage: %s", err)
+	backups = filterPrefix(backups, conf.prefix)
+	for i := len(backups) - 1; i >= 0; i-- {
+		if conf.before.IsZero() || !backups[i].Time.After(conf.before) {
+			return backups[i].Name, nil
+		}
 	}
-	err = sshStorage.CopyFrom(file)
-	if err != nil {
-		utils.Fatal("Error copying file, error %v", err)
+	if !conf.before.IsZero() {
+		return "", fmt.Errorf("no backup found before %s", conf.before.Format(utils.TimeFormat()))
 	}
-	RestoreData(file)
+	return "", fmt.Errorf("no backup found")
 }
-func restoreFromFTP(file, remotePath string) {
-	utils.Info("Restore data from FTP server")
-	ftpConfig := initFtpConfig()
-	ftpStorage, err := ftp.NewStorage(ftp.Config{
-		Host:       ftpConfig.host,
-		Port:       ftpConfig.port,
-		User:       ftpConfig.user,
-		Password:   ftpConfig.password,
-		RemotePath: remotePath,
-		LocalPath:  tmpPath,
-	})
-	if err != nil {
-		utils.Fatal("Error creating FTP storage: %s", err)
-	}
-	err = ftpStorage.Copy(file)
-	if err != nil {
-		utils.Fatal("Error download file from FTP server: %s %v", filepath.Join(remotePath, file), err)
-	}
-	RestoreData(file)
+
+// restoreOptions selects what is restored and where
+type restoreOptions struct {
+	// root is the directory the backup is extracted to, the restore target or its staging directory
+	root string
+	// target is the directory the staging directory is moved to, empty when the backup is extracted in place
+	target string
+	// overlay keeps the existing files of the target, they are resolved when checking the restored symlinks
+	overlay bool
+	// removed collects the paths deleted by the replayed incremental backups, nil to not collect them
+	removed map[string]bool
+	// plan collects what the restore would do for a dry run, nothing is written when set
+	plan *restorePlan
+	// members restores only these paths and their content, all paths when empty
+	members []string
+	// filter selects the restored paths with the --include and --exclude patterns
+	filter *pathFilter
+	// verifier checks the signatures of the restored files, signature is the one of the archive being restored
+	verifier  *signatureVerifier
+	signature *fileSignature
 }
 
-// RestoreData restore database
-func RestoreData(file string) {
-	gpgPassphrase := os.Getenv("GPG_PASSPHRASE")
+// RestoreData restores a backup archive stream, it is decrypted, decompressed and extracted while it is read.
+// The stored stream is checked against the signature block by block before it is decrypted, the extracted files
+// are only moved to the target once the whole stream matches.
+func RestoreData(file string, stream io.Reader, opts restoreOptions) {
 	if file == "" {
 		utils.Fatal("Error, file required")
 	}
-	extension := filepath.Ext(filepath.Join(tmpPath, file))
-	rFile, err := os.ReadFile(filepath.Join(tmpPath, file))
-	outputFile := RemoveLastExtension(filepath.Join(tmpPath, file))
+	stored := opts.signature.reader(stream)
+	reader, err := decryptStream(file, stored)
 	if err != nil {
-		utils.Fatal("Error reading backup file: %s ", err)
-	}
-	if extension == ".gpg" {
-		if gpgPassphrase == "" {
-			utils.Fatal("Error: GPG passphrase is required, your file seems to be a GPG file.\nYou need to provide GPG keys. GPG_PASSPHRASE environment variable is required.")
-
-		} else {
-			//Decrypt file
-			err := encryptor.Decrypt(rFile, outputFile, gpgPassphrase)
-			if err != nil {
-				utils.Fatal("Error decrypting file %s %v", file, err)
-			}
-			//Update file name
-			file = RemoveLastExtension(file)
-		}
+		utils.Fatal("Error decrypting file %s %v", file, stored.failed(err))
 	}
-
-	if utils.FileExists(filepath.Join(tmpPath, file)) {
-		utils.Info("Restoring backup...")
-		if filepath.Ext(filepath.Join(tmpPath, file)) == ".tar" {
-			err := extractTar(filepath.Join(tmpPath, file))
-			if err != nil {
-				utils.Fatal("Error extracting file %s %v", file, err)
-			}
-		} else {
-			err := extractTarGz(filepath.Join(tmpPath, file))
-			if err != nil {
-				utils.Fatal("Error extracting file %s %v", file, err)
-			}
-		}
-		utils.Info("Backup has been restored.")
-
-	} else {
-		utils.Fatal("File not found in %s", fmt.Sprintf("%s/%s", tmpPath, file))
+	utils.Info("Restoring backup...")
+	err = extractStream(reader, opts)
+	if err == nil {
+		// The end of the stored stream is read, the signature and the volumes of split archives are checked at its end
+		err = stored.finish()
 	}
-
-}
-
-// Extracts a .tar archive to the specified output directory
-func extractTar(archivePath string) error {
-	utils.Info("Extracting backup...")
-	// Open the .tar archive for reading
-	file, err := os.Open(archivePath)
 	if err != nil {
-		return err
+		utils.Fatal("Error extracting file %s %v", file, stored.failed(err))
 	}
-	defer file.Close()
-
-	// Create a tar reader
-	tarReader := tar.NewReader(file)
-
-	// Iterate through the files in the tar archive
-	for {
-		// Read the next header from the tar file
-		header, err := tarReader.Next()
-		if err == io.EOF {
-			// End of tar archive
-			break
-		}
-		if err != nil {
-			return err
-		}
-
-		// Determine the output path for the current file or directory
-		outputPath := filepath.Join(dataPath, header.Name)
-
-		switch header.Typeflag {
-		case tar.TypeDir:
-			// Create the directory if it doesn't exist
-			if err := os.MkdirAll(outputPath, os.FileMode(header.Mode)); err != nil {
-				return err
-			}
-
-		case tar.TypeReg:
-			// Create all parent directories if necessary
-			if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
-				return err
-			}
-
-			// Create the file and set the appropriate permissions
-			outFile, err := os.Create(outputPath)
-			if err != nil {
-				return err
-			}
-			defer outFile.Close()
-
-			// Copy the file contents from the tar archive to the output file
-			if _, err := io.Copy(outFile, tarReader); err != nil {
-				return err
-			}
-
-			// Set the file permissions
-			if err := os.Chmod(outputPath, os.FileMode(header.Mode)); err != nil {
-				return err
-			}
-
-		default:
-			// Handle other file types (e.g., symlinks, etc.) if needed
-			fmt.Printf("Skipping file type: %c in file %s\n", header.Typeflag, header.Name)
-		}
+	if opts.plan == nil {
+		utils.Info("Backup has been restored.")
 	}
-	utils.Info("Extracting backup...done")
-
-	return nil
 }
 
-// Extracts a .tar.gz archive to the specified output directory
-func extractTarGz(archivePath string) error {
+// extractStream extracts a compressed archive stream, the compression codec is detected from its content
+func extractStream(stream io.Reader, opts restoreOptions) error {
 	utils.Info("Extracting backup...")
-
-	file, err := os.Open(archivePath)
+	reader, codec, err := newDecompressReader(stream)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	defer reader.Close()
+	utils.Info("Compression: %s", codec)
 
-	// Create a gzip reader
-	gzReader, err := gzip.NewReader(file)
+	err = extractArchive(reader, opts)
 	if err != nil {
 		return err
 	}
-	defer gzReader.Close()
-
-	tarReader := tar.NewReader(gzReader)
-
-	for {
-		header, err := tarReader.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
-
-		outputPath := filepath.Join(dataPath, header.Name)
-		switch header.Typeflag {
-		case tar.TypeDir:
-			// Create directories
-			if err := os.MkdirAll(outputPath, os.FileMode(header.Mode)); err != nil {
-				return err
-			}
-		case tar.TypeReg:
-			// Create files and write data
-			if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
-				return err
-			}
-
-			outFile, err := os.Create(outputPath)
-			if err != nil {
-				return err
-			}
-			defer outFile.Close()
-
-			if _, err := io.Copy(outFile, tarReader); err != nil {
-				return err
-			}
-
-			if err := os.Chmod(outputPath, os.FileMode(header.Mode)); err != nil {
-				return err
-			}
-		default:
-			fmt.Printf("Skipping unsupported file type: %c in file %s\n", header.Typeflag, header.Name)
-		}
+	// The end of the stream is read, the compression and encryption checksums are checked at its end.
+	// The reader is hidden behind an io.Reader, pgzip fails when WriteTo is called after Read.
+	if _, err := io.Copy(io.Discard, struct{ io.Reader }{reader}); err != nil {
+		return err
 	}
 	utils.Info("Extracting backup...done")
-
 	return nil
 }
+
+// extractArchive extracts a tar stream to the restore root, rejecting hostile entries
+func extractArchive(reader io.Reader, opts restoreOptions) error {
+	e := newExtractor(opts)
+	err := e.extract(reader)
+	e.summary()
+	return err
+}
@@ -0,0 +1,555 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/jkaninda/volume-backup/utils"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Signature algorithms, recorded in the signature files
+const (
+	signatureEd25519 = "ed25519"
+	signatureOpenPGP = "openpgp"
+	signatureHMAC    = "hmac-sha256"
+)
+
+// signatureBlockSize is the size of the blocks of a stored file whose digests are signed,
+// each block is checked before it is decrypted or extracted
+const signatureBlockSize = 4 << 20
+
+// maxSignatureBlockSize is the largest block size accepted in a signature, a block is read in memory
+const maxSignatureBlockSize = 64 << 20
+
+// fileSignature signs the name, size and SHA-256 of a stored file and the digests of its blocks, it is stored next
+// to it with the .sig extension. The stored bytes are signed, a modified encrypted file is refused before it is decrypted.
+type fileSignature struct {
+	File      string   `json:"file"`
+	Size      int64    `json:"size"`
+	SHA256    string   `json:"sha256"`
+	BlockSize int64    `json:"blockSize"`
+	Blocks    []string `json:"blocks"`
+	Algorithm string   `json:"algorithm"`
+	KeyID     string   `json:"keyId,omitempty"`
+	Signature string   `json:"signature"`
+	// allowMismatch only warns when the content does not match, with --allow-unsigned
+	allowMismatch bool
+}
+
+// signatureName returns the name of the signature file of a stored file
+func signatureName(name string) string {
+	return fmt.Sprintf("%s.sig", name)
+}
+
+// statement returns the signed message
+func (s *fileSignature) statement() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "volume-backup signature v2\nfile: %s\nsize: %d\nsha256: %s\nblock size: %d\n", s.File, s.Size, s.SHA256, s.BlockSize)
+	for _, block := range s.Blocks {
+		fmt.Fprintf(&buf, "block: %s\n", block)
+	}
+	return buf.Bytes()
+}
+
+// check fails if a content digest does not match the signature, a nil signature is not checked
+func (s *fileSignature) check(digest contentDigest) error {
+	if s == nil || (digest.size == s.Size && digest.sha256 == s.SHA256) {
+		return nil
+	}
+	return s.mismatch()
+}
+
+// mismatch returns the error of a file not matching its signature, it is only a warning with --allow-unsigned
+func (s *fileSignature) mismatch() error {
+	if s.allowMismatch {
+		utils.Warn("%s does not match its signature, --allow-unsigned is set", s.File)
+		return nil
+	}
+	return fmt.Errorf("%s does not match its signature, it was modified after the backup", s.File)
+}
+
+// contentDigest is the size and SHA-256 of a stored file, with the SHA-256 of each of its blocks
+type contentDigest struct {
+	size   int64
+	sha256 string
+	blocks []string
+}
+
+// digestBytes returns the digest of a content read in memory
+func digestBytes(data []byte) contentDigest {
+	d := newDigestWriter(io.Discard)
+	_, _ = d.Write(data)
+	return d.digest()
+}
+
+// storedDigest returns the digest of a file of the temp directory, as it is stored
+func storedDigest(name string) (contentDigest, error) {
+	file, err := os.Open(filepath.Join(tmpPath, name))
+	if err != nil {
+		return contentDigest{}, err
+	}
+	defer file.Close()
+	d := newDigestWriter(io.Discard)
+	if _, err := io.Copy(d, file); err != nil {
+		return contentDigest{}, err
+	}
+	return d.digest(), nil
+}
+
+// digestWriter computes the digest of what is written to w
+type digestWriter struct {
+	w      io.Writer
+	hash   hash.Hash
+	size   int64
+	block  hash.Hash
+	filled int64
+	blocks []string
+}
+
+func newDigestWriter(w io.Writer) *digestWriter {
+	return &digestWriter{w: w, hash: sha256.New(), block: sha256.New()}
+}
+
+func (d *digestWriter) Write(p []byte) (int, error) {
+	n, err := d.w.Write(p)
+	d.hash.Write(p[:n])
+	d.size += int64(n)
+	for data := p[:n]; len(data) > 0; {
+		part := data[:min(int64(len(data)), signatureBlockSize-d.filled)]
+		d.block.Write(part)
+		d.filled += int64(len(part))
+		data = data[len(part):]
+		if d.filled == signatureBlockSize {
+			d.endBlock()
+		}
+	}
+	return n, err
+}
+
+// endBlock records the digest of the current block
+func (d *digestWriter) endBlock() {
+	d.blocks = append(d.blocks, hex.EncodeToString(d.block.Sum(nil)))
+	d.block.Reset()
+	d.filled = 0
+}
+
+func (d *digestWriter) digest() contentDigest {
+	if d.filled > 0 {
+		d.endBlock()
+	}
+	return contentDigest{size: d.size, sha256: hex.EncodeToString(d.hash.Sum(nil)), blocks: d.blocks}
+}
+
+// signedReader checks a stored stream against its signature while it is read. Each block is read in memory and
+// checked before it is returned, nothing that does not match the signature reaches the decryption and the extraction.
+type signedReader struct {
+	stream    io.Reader
+	signature *fileSignature
+	hash      hash.Hash
+	size      int64
+	buf       []byte
+	// block is the rest of the checked block being read
+	block []byte
+	next  int
+	eof   bool
+	err   error
+}
+
+// reader returns a reader of the stored stream checked against the signature, a nil signature is not checked
+func (s *fileSignature) reader(stream io.Reader) *signedReader {
+	return &signedReader{stream: stream, signature: s, hash: sha256.New()}
+}
+
+func (r *signedReader) Read(p []byte) (int, error) {
+	for len(r.block) == 0 {
+		if r.signature == nil {
+			return r.stream.Read(p)
+		}
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.readBlock()
+	}
+	n := copy(p, r.block)
+	r.block = r.block[n:]
+	return n, nil
+}
+
+// readBlock reads and checks the next block of the stream, io.EOF is returned once the whole stream is checked
+func (r *signedReader) readBlock() error {
+	if r.eof {
+		if r.next != len(r.signature.Blocks) {
+			if err := r.signature.mismatch(); err != nil {
+				return err
+			}
+		}
+		if err := r.signature.check(contentDigest{size: r.size, sha256: hex.EncodeToString(r.hash.Sum(nil))}); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	if r.buf == nil {
+		r.buf = make([]byte, r.signature.BlockSize)
+	}
+	n, err := io.ReadFull(r.stream, r.buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// Streams are not read again after io.EOF, OpenPGP streams fail when they are
+		r.eof, err = true, nil
+	}
+	if err != nil {
+		return err
+	}
+	data := r.buf[:n]
+	r.hash.Write(data)
+	r.size += int64(n)
+	if n > 0 {
+		sum := sha256.Sum256(data)
+		if r.next >= len(r.signature.Blocks) || hex.EncodeToString(sum[:]) != r.signature.Blocks[r.next] {
+			if err := r.signature.mismatch(); err != nil {
+				return err
+			}
+			// With --allow-unsigned, the rest of the stream is read without checking it
+			r.signature = nil
+		}
+		r.next++
+	}
+	r.block = data
+	return nil
+}
+
+// finish reads the end of the stored stream, the stream is checked against the signature once it is read
+func (r *signedReader) finish() error {
+	_, err := io.Copy(io.Discard, struct{ io.Reader }{r})
+	return err
+}
+
+// failed returns the error of a stream that does not match its signature. The decryption and decompression readers
+// report it as invalid data, it is returned instead of their errors.
+func (r *signedReader) failed(err error) error {
+	if r.err != nil && r.err != io.EOF {
+		return r.err
+	}
+	return err
+}
+
+// signer signs the stored files with an Ed25519 or OpenPGP private key, or with an HMAC key
+type signer struct {
+	algorithm string
+	keyID     string
+	ed25519   ed25519.PrivateKey
+	entity    *openpgp.Entity
+	hmacKey   []byte
+}
+
+// newSigner creates the signer of the backups, it returns nil when no key file or HMAC key is set.
+// The key passphrase is cleared once the key is unlocked, the signer owns the HMAC key, it is cleared by wipe.
+func newSigner(keyFile string, keyPassphrase, hmacKey []byte) (*signer, error) {
+	defer clear(keyPassphrase)
+	if keyFile != "" && len(hmacKey) > 0 {
+		clear(hmacKey)
+		return nil, errors.New("a signing key file and an HMAC key cannot be combined")
+	}
+	if len(hmacKey) > 0 {
+		return &signer{algorithm: signatureHMAC, hmacKey: hmacKey}, nil
+	}
+	if keyFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil && block.Type == "PRIVATE KEY" {
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error reading signing key %s: %w", keyFile, err)
+		}
+		private, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("signing key %s is not an Ed25519 key", keyFile)
+		}
+		return &signer{algorithm: signatureEd25519, keyID: ed25519KeyID(private.Public().(ed25519.PublicKey)), ed25519: private}, nil
+	}
+	keys, err := readKeyRing(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading signing key %s: %w", keyFile, err)
+	}
+	entity := keys[0]
+	if entity.PrivateKey == nil {
+		return nil, fmt.Errorf("%s is not a private key", keyFile)
+	}
+	if _, ok := entity.SigningKey(time.Now()); !ok {
+		return nil, fmt.Errorf("key %s of %s cannot be used for signing", entity.PrimaryKey.KeyIdString(), keyFile)
+	}
+	if err := entity.DecryptPrivateKeys(keyPassphrase); err != nil {
+		return nil, fmt.Errorf("error unlocking signing key %s, check SIGNING_KEY_PASSPHRASE: %w", keyFile, err)
+	}
+	return &signer{algorithm: signatureOpenPGP, keyID: entity.PrimaryKey.KeyIdString(), entity: entity}, nil
+}
+
+// ed25519KeyID returns the identifier of an Ed25519 public key, the beginning of its SHA-256
+func ed25519KeyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// wipe clears the HMAC key from memory, the signer cannot be used anymore
+func (s *signer) wipe() {
+	if s == nil {
+		return
+	}
+	clear(s.hmacKey)
+}
+
+// sign signs the digest of a stored file
+func (s *signer) sign(name string, digest contentDigest) (*fileSignature, error) {
+	signature := &fileSignature{File: name, Size: digest.size, SHA256: digest.sha256, BlockSize: signatureBlockSize, Blocks: digest.blocks, Algorithm: s.algorithm, KeyID: s.keyID}
+	var sig []byte
+	switch s.algorithm {
+	case signatureEd25519:
+		sig = ed25519.Sign(s.ed25519, signature.statement())
+	case signatureOpenPGP:
+		var buf bytes.Buffer
+		if err := openpgp.DetachSign(&buf, s.entity, bytes.NewReader(signature.statement()), nil); err != nil {
+			return nil, err
+		}
+		sig = buf.Bytes()
+	case signatureHMAC:
+		mac := hmac.New(sha256.New, s.hmacKey)
+		mac.Write(signature.statement())
+		sig = mac.Sum(nil)
+	}
+	signature.Signature = base64.StdEncoding.EncodeToString(sig)
+	return signature, nil
+}
+
+// uploadSignature signs a file of the temp directory as it is stored and uploads its signature,
+// nothing is signed without a signer
+func uploadSignature(u uploader, s *signer, name string) error {
+	if s == nil {
+		return nil
+	}
+	digest, err := storedDigest(name)
+	if err != nil {
+		return err
+	}
+	return putSignature(u, s, name, signatureName(name), digest)
+}
+
+// putSignature signs the digest of a stored file and uploads the signature as sigName
+func putSignature(u uploader, s *signer, name, sigName string, digest contentDigest) error {
+	signature, err := s.sign(name, digest)
+	if err != nil {
+		return fmt.Errorf("error signing %s: %w", name, err)
+	}
+	data, err := json.MarshalIndent(signature, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(tmpPath, sigName), data, 0600); err != nil {
+		return err
+	}
+	if err := u.Put(sigName); err != nil {
+		return fmt.Errorf("error uploading %s: %w", sigName, err)
+	}
+	utils.Info("%s signed with %s, signature %s", name, s.algorithm, sigName)
+	return nil
+}
+
+// signatureVerifier checks the signatures of the restored and verified backups.
+// Unsigned files and invalid signatures are refused, unless allowUnsigned is set.
+type signatureVerifier struct {
+	allowUnsigned bool
+	ed25519       []ed25519.PublicKey
+	keys          openpgp.EntityList
+	hmacKey       []byte
+}
+
+// newSignatureVerifier creates the verifier of the backups from the environment, with the public keys of
+// SIGNING_PUBLIC_KEY_FILE, the signing key of SIGNING_KEY_FILE or the HMAC key
+func newSignatureVerifier(allowUnsigned bool) (*signatureVerifier, error) {
+	hmacKey, err := utils.GetSecretBytes("SIGNING_HMAC_KEY")
+	if err != nil {
+		return nil, err
+	}
+	v := &signatureVerifier{allowUnsigned: allowUnsigned, hmacKey: hmacKey}
+	keyFiles := splitEnv("SIGNING_PUBLIC_KEY_FILE")
+	if len(keyFiles) == 0 && os.Getenv("SIGNING_KEY_FILE") != "" {
+		keyFiles = []string{os.Getenv("SIGNING_KEY_FILE")}
+	}
+	for _, keyFile := range keyFiles {
+		if err := v.addKeyFile(keyFile); err != nil {
+			v.wipe()
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// addKeyFile reads an Ed25519 key, public or private, or OpenPGP keys
+func (v *signatureVerifier) addKeyFile(keyFile string) error {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		var key any
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+			if private, ok := key.(ed25519.PrivateKey); ok {
+				key = private.Public()
+			}
+		default:
+			return fmt.Errorf("unsupported key type %s in %s", block.Type, keyFile)
+		}
+		if err != nil {
+			return fmt.Errorf("error reading signing public key %s: %w", keyFile, err)
+		}
+		public, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("signing public key %s is not an Ed25519 key", keyFile)
+		}
+		v.ed25519 = append(v.ed25519, public)
+		return nil
+	}
+	keys, err := readKeyRing(keyFile)
+	if err != nil {
+		return fmt.Errorf("error reading signing public key %s: %w", keyFile, err)
+	}
+	v.keys = append(v.keys, keys...)
+	return nil
+}
+
+// wipe clears the HMAC key from memory
+func (v *signatureVerifier) wipe() {
+	if v == nil {
+		return
+	}
+	clear(v.hmacKey)
+}
+
+// hasKeys reports whether a signature can be checked
+func (v *signatureVerifier) hasKeys() bool {
+	return len(v.ed25519) > 0 || len(v.keys) > 0 || len(v.hmacKey) > 0
+}
+
+// fetch downloads and checks the signature of a stored file before it is read. It returns nil when the file is
+// not checked, with --allow-unsigned.
+func (v *signatureVerifier) fetch(b backend, name string) (*fileSignature, error) {
+	signature, err := v.download(b, name)
+	if err == nil {
+		err = v.verify(name, signature)
+	}
+	if err != nil {
+		if v.allowUnsigned {
+			utils.Warn("%v, --allow-unsigned is set", err)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w, use --allow-unsigned to read it anyway", err)
+	}
+	if signature.KeyID != "" {
+		utils.Info("Signature of %s is valid, %s key %s", name, signature.Algorithm, signature.KeyID)
+	} else {
+		utils.Info("Signature of %s is valid, %s", name, signature.Algorithm)
+	}
+	signature.allowMismatch = v.allowUnsigned
+	return signature, nil
+}
+
+// checkTempFile checks the signature of a stored file downloaded to the temp directory, before it is decrypted
+func (v *signatureVerifier) checkTempFile(b backend, name string) error {
+	signature, err := v.fetch(b, name)
+	if err != nil || signature == nil {
+		return err
+	}
+	digest, err := storedDigest(name)
+	if err != nil {
+		return err
+	}
+	return signature.check(digest)
+}
+
+// download reads the signature file of a stored file
+func (v *signatureVerifier) download(b backend, name string) (*fileSignature, error) {
+	sigName := signatureName(name)
+	if err := download(b, sigName); err != nil {
+		return nil, fmt.Errorf("%s is not signed, %s not found", name, sigName)
+	}
+	data, err := os.ReadFile(filepath.Join(tmpPath, sigName))
+	if err != nil {
+		return nil, err
+	}
+	signature := &fileSignature{}
+	if err := json.Unmarshal(data, signature); err != nil {
+		return nil, fmt.Errorf("invalid signature %s: %w", sigName, err)
+	}
+	return signature, nil
+}
+
+// verify checks a signature with the keys of its algorithm
+func (v *signatureVerifier) verify(name string, signature *fileSignature) error {
+	if !v.hasKeys() {
+		return fmt.Errorf("the signature of %s cannot be checked, SIGNING_PUBLIC_KEY_FILE or SIGNING_HMAC_KEY environment variable is required", name)
+	}
+	// Signatures are bound to the file name, a signed backup cannot replace another one
+	if signature.File != name {
+		return fmt.Errorf("the signature of %s was created for %s", name, signature.File)
+	}
+	if signature.BlockSize <= 0 || signature.BlockSize > maxSignatureBlockSize {
+		return fmt.Errorf("invalid signature of %s, unsupported block size %d", name, signature.BlockSize)
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature of %s: %w", name, err)
+	}
+	valid := false
+	switch signature.Algorithm {
+	case signatureEd25519:
+		for _, key := range v.ed25519 {
+			if ed25519.Verify(key, signature.statement(), sig) {
+				valid = true
+				break
+			}
+		}
+	case signatureOpenPGP:
+		if len(v.keys) > 0 {
+			_, err := openpgp.CheckDetachedSignature(v.keys, bytes.NewReader(signature.statement()), bytes.NewReader(sig), nil)
+			valid = err == nil
+		}
+	case signatureHMAC:
+		if len(v.hmacKey) > 0 {
+			mac := hmac.New(sha256.New, v.hmacKey)
+			mac.Write(signature.statement())
+			valid = hmac.Equal(mac.Sum(nil), sig)
+		}
+	default:
+		return fmt.Errorf("unsupported signature algorithm %s for %s", signature.Algorithm, name)
+	}
+	if !valid {
+		return fmt.Errorf("invalid %s signature of %s, no key matches", signature.Algorithm, name)
+	}
+	return nil
+}
@@ -0,0 +1,501 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jkaninda/volume-backup/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	modeFull         = "full"
+	modeIncremental  = "incremental"
+	modeDifferential = "differential"
+)
+
+// snapshotEntry holds the state of a path, used to detect changes between two backups
+type snapshotEntry struct {
+	ModTime int64  `json:"mtime"`
+	Size    int64  `json:"size"`
+	Inode   uint64 `json:"inode"`
+	IsDir   bool   `json:"dir,omitempty"`
+}
+
+// snapshotIndex describes the content of the volume at the time of a backup.
+// It is stored next to the archive and is used to build the next incremental or differential backup.
+type snapshotIndex struct {
+	Archive   string    `json:"archive"`
+	Mode      string    `json:"mode"`
+	Parent    string    `json:"parent,omitempty"`
+	Chain     []string  `json:"chain"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Sequence is the number of backups since the last full backup, 0 for a full backup
+	Sequence int                      `json:"sequence,omitempty"`
+	Deleted  []string                 `json:"deleted,omitempty"`
+	Files    map[string]snapshotEntry `json:"files"`
+	// base is the index changes are compared against, nil for full backups
+	base *snapshotIndex
+	// root is the path files are compared from, when the archive is created from a staged copy
+	root string
+}
+
+// newSnapshotIndex creates an empty index, base is nil for full backups
+func newSnapshotIndex(mode string, base *snapshotIndex) *snapshotIndex {
+	return &snapshotIndex{
+		Mode:      mode,
+		CreatedAt: time.Now(),
+		Files:     make(map[string]snapshotEntry),
+		base:      base,
+	}
+}
+
+// track records a path in the index and reports whether it has to be archived
+func (s *snapshotIndex) track(relPath string, info os.FileInfo) bool {
+	if s.root != "" {
+		if original, err := os.Lstat(filepath.Join(s.root, relPath)); err == nil {
+			info = original
+		}
+	}
+	entry := snapshotEntry{
+		ModTime: info.ModTime().UnixNano(),
+		Size:    info.Size(),
+		Inode:   fileInode(info),
+		IsDir:   info.IsDir(),
+	}
+	s.Files[relPath] = entry
+	// Directories are always archived to keep the tree and its permissions
+	if s.base == nil || info.IsDir() {
+		return true
+	}
+	previous, ok := s.base.Files[relPath]
+	return !ok || previous != entry
+}
+
+// finalize sets the archive name, the restore chain and the tombstones of deleted paths
+func (s *snapshotIndex) finalize(archive string) {
+	s.Archive = archive
+	s.Chain = []string{archive}
+	if s.base == nil {
+		return
+	}
+	s.Parent = s.base.Archive
+	s.Chain = append(append([]string{}, s.base.Chain...), archive)
+	for path := range s.base.Files {
+		if _, ok := s.Files[path]; !ok {
+			s.Deleted = append(s.Deleted, path)
+		}
+	}
+	sort.Strings(s.Deleted)
+}
+
+// snapshotIndexName returns the index file name of a backup archive
+func snapshotIndexName(backupFileName string) string {
+	return fmt.Sprintf("%s.index.json", trimEncryptionExtension(backupFileName))
+}
+
+// snapshotChain lists the archives a backup is restored from. It is stored in clear next to the index,
+// pruning reads it to keep the archives of the retained backups without the keys of encrypted indexes.
+type snapshotChain struct {
+	Archive string   `json:"archive"`
+	Chain   []string `json:"chain"`
+}
+
+// snapshotChainName returns the chain file name of a backup archive
+func snapshotChainName(backupFileName string) string {
+	return fmt.Sprintf("%s.chain.json", trimEncryptionExtension(backupFileName))
+}
+
+// writeSnapshotIndex writes the index to the temp directory, encrypted if the backup is encrypted.
+// It returns the name of the written file.
+func writeSnapshotIndex(index *snapshotIndex, config *BackupConfig) (string, error) {
+	name := snapshotIndexName(config.backupFileName)
+	data, err := json.Marshal(index)
+	if err != nil {
+		return "", err
+	}
+	err = os.WriteFile(filepath.Join(tmpPath, name), data, 0600)
+	if err != nil {
+		return "", err
+	}
+	// The index is encrypted like its archive
+	if config.encrypter != nil {
+		encryptBackup(name, config.encrypter)
+		name = config.encrypter.fileName(name)
+	}
+	return name, nil
+}
+
+// readSnapshotIndex reads an index file from the temp directory, decrypting it if needed
+func readSnapshotIndex(name string) (*snapshotIndex, error) {
+	data, err := readTempFile(name)
+	if err != nil {
+		return nil, err
+	}
+	index := &snapshotIndex{}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("invalid snapshot index %s: %w", name, err)
+	}
+	return index, nil
+}
+
+// loadBaseSnapshot loads the index the next backup of the given mode is compared against.
+// Incremental backups are based on the last backup, differential backups on the last full backup.
+// A full backup is created again once the fullEvery interval is reached. It also returns the sequence of the next backup.
+func loadBaseSnapshot(prefix, mode string, fullEvery fullInterval) (*snapshotIndex, int) {
+	if mode == modeFull {
+		return nil, 0
+	}
+	last := readSnapshotState(snapshotStateFile(prefix, modeIncremental))
+	full := readSnapshotState(snapshotStateFile(prefix, modeFull))
+	if last == nil || (mode == modeDifferential && full == nil) {
+		utils.Warn("No previous snapshot index found for %s, creating a full backup", prefix)
+		return nil, 0
+	}
+	if fullEvery.due(last, full) {
+		utils.Info("Full backup interval of %s reached, creating a full backup", fullEvery)
+		return nil, 0
+	}
+	if mode == modeDifferential {
+		return full, last.Sequence + 1
+	}
+	return last, last.Sequence + 1
+}
+
+// readSnapshotState reads a local state file, nil if it does not exist or is invalid
+func readSnapshotState(name string) *snapshotIndex {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			utils.Error("Error reading snapshot index %s: %v", name, err)
+		}
+		return nil
+	}
+	index := &snapshotIndex{}
+	if err := json.Unmarshal(data, index); err != nil {
+		utils.Error("Invalid snapshot index %s: %v", name, err)
+		return nil
+	}
+	return index
+}
+
+// fullInterval is the interval between two full backups of incremental and differential modes, a number of backups
+// or of days. The zero value never creates a full backup again.
+type fullInterval struct {
+	backups int
+	days    int
+}
+
+// parseFullInterval parses a --full-every value, eg: 10 for every 10 backups or 7d for every 7 days
+func parseFullInterval(value string) (fullInterval, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return fullInterval{}, nil
+	}
+	days := strings.HasSuffix(value, "d")
+	n, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+	if err != nil || n <= 0 {
+		return fullInterval{}, fmt.Errorf("invalid full backup interval %s, eg: 10 for every 10 backups or 7d for every 7 days", value)
+	}
+	if days {
+		return fullInterval{days: n}, nil
+	}
+	return fullInterval{backups: n}, nil
+}
+
+func (f fullInterval) String() string {
+	if f.days > 0 {
+		return fmt.Sprintf("%d days", f.days)
+	}
+	return fmt.Sprintf("%d backups", f.backups)
+}
+
+// due reports whether the next backup is a full backup, from the indexes of the last backup and the last full backup
+func (f fullInterval) due(last, full *snapshotIndex) bool {
+	switch {
+	case f.backups > 0:
+		// The last full backup counts as the first backup of the interval
+		return last.Sequence+1 >= f.backups
+	case f.days > 0:
+		if full == nil {
+			full = last
+		}
+		return time.Since(full.CreatedAt) >= time.Duration(f.days)*24*time.Hour
+	}
+	return false
+}
+
+// saveSnapshotState keeps the index of the last uploaded backup, used as base for the next backups
+func saveSnapshotState(prefix string, index *snapshotIndex) error {
+	err := os.MkdirAll(snapshotPath, 0700)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(snapshotStateFile(prefix, modeIncremental), data, 0600)
+	if err != nil {
+		return err
+	}
+	if index.Mode == modeFull {
+		return os.WriteFile(snapshotStateFile(prefix, modeFull), data, 0600)
+	}
+	return nil
+}
+
+// snapshotStateFile returns the local state file of the last backup (incremental) or the last full backup
+func snapshotStateFile(prefix, mode string) string {
+	if mode == modeFull {
+		return filepath.Join(snapshotPath, fmt.Sprintf("%s.full.json", prefix))
+	}
+	return filepath.Join(snapshotPath, fmt.Sprintf("%s.json", prefix))
+}
+
+// copySnapshotIndex uploads the index next to the archive and saves it as the local state.
+// It returns an error once the index could not be uploaded to any storage.
+func copySnapshotIndex(dests destinations, config *BackupConfig, finalFileName string) error {
+	if config.snapshot == nil {
+		return nil
+	}
+	config.snapshot.finalize(finalFileName)
+	name, err := writeSnapshotIndex(config.snapshot, config)
+	if err != nil {
+		return fmt.Errorf("error writing snapshot index: %w", err)
+	}
+	err = dests.Put(name)
+	if err != nil {
+		return fmt.Errorf("error copying snapshot index: %w", err)
+	}
+	// The index lists the archives replayed on restore and the deleted paths, it is signed like them
+	err = uploadSignature(dests, config.signer, name)
+	if err != nil {
+		return fmt.Errorf("error signing snapshot index: %w", err)
+	}
+	data, err := json.Marshal(snapshotChain{Archive: finalFileName, Chain: config.snapshot.Chain})
+	if err == nil {
+		err = os.WriteFile(filepath.Join(tmpPath, snapshotChainName(finalFileName)), data, 0600)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing snapshot chain: %w", err)
+	}
+	err = dests.Put(snapshotChainName(finalFileName))
+	if err != nil {
+		return fmt.Errorf("error copying snapshot chain: %w", err)
+	}
+	// The next backups are based on the previous one until the backup is on every storage, their chain stays restorable
+	if len(dests.active()) < len(dests) {
+		utils.Warn("Backup is missing from a storage, the next backup is not based on it")
+		return nil
+	}
+	err = saveSnapshotState(config.prefix, config.snapshot)
+	if err != nil {
+		utils.Error("Error saving snapshot index, next backup will be a full backup: %v", err)
+	}
+	return nil
+}
+
+// chainedArchives returns the archives the backups created after limit are restored from, with their chain files.
+// The chain of backups stored without a chain file is read from their index, it must not be encrypted.
+func chainedArchives(b backend, files []storedFile, limit time.Time) (map[string]bool, error) {
+	archives := make(map[string]bool)
+	known := make(map[string]bool)
+	for _, file := range files {
+		if !strings.HasSuffix(file.name, ".chain.json") || file.modTime.Before(limit) {
+			continue
+		}
+		chain := &snapshotChain{}
+		if err := readStoredJSON(b, file.name, chain); err != nil {
+			return nil, fmt.Errorf("error reading snapshot chain %s: %w", file.name, err)
+		}
+		for _, archive := range chain.Chain {
+			archives[trimEncryptionExtension(archive)] = true
+		}
+		known[strings.TrimSuffix(file.name, ".chain.json")] = true
+	}
+	for _, file := range files {
+		archive, ok := strings.CutSuffix(trimEncryptionExtension(file.name), ".index.json")
+		if !ok || known[archive] || file.modTime.Before(limit) || isRepositoryFile(file.name) {
+			continue
+		}
+		if encryptionExtension(file.name) != "" {
+			return nil, fmt.Errorf("the chain of %s is unknown, its index is encrypted", archive)
+		}
+		index := &snapshotIndex{}
+		if err := readStoredJSON(b, file.name, index); err != nil {
+			return nil, fmt.Errorf("error reading snapshot index %s: %w", file.name, err)
+		}
+		for _, name := range index.Chain {
+			archives[trimEncryptionExtension(name)] = true
+		}
+	}
+	return archives, nil
+}
+
+// readStoredJSON reads a stored JSON file without downloading it to the temp directory
+func readStoredJSON(b backend, name string, v any) error {
+	stream, err := b.Get(name)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	return json.NewDecoder(stream).Decode(v)
+}
+
+// inChain reports whether a stored file is one of the archives or a file of them, eg: a volume, an index or a signature
+func inChain(name string, archives map[string]bool) bool {
+	for i := range name {
+		if name[i] == '.' && archives[name[:i]] {
+			return true
+		}
+	}
+	return archives[name]
+}
+
+// restoreChain restores a backup, replaying the chain of archives for incremental and differential backups
+func restoreChain(b backend, file string, opts restoreOptions) {
+	if file == "" {
+		utils.Fatal("Error, file required")
+	}
+	if isRepositorySnapshot(file) {
+		restoreRepository(b, file, opts)
+		return
+	}
+	indexName := snapshotIndexName(file)
+	if ext := encryptionExtension(file); ext != "" {
+		indexName = fmt.Sprintf("%s.%s", indexName, ext)
+	}
+	if err := download(b, indexName); err != nil {
+		// Single file backups and backups created by older versions have no index
+		utils.Info("No snapshot index found for %s, restoring a single archive", file)
+		restoreArchive(b, file, opts)
+		return
+	}
+	index, err := readSignedSnapshotIndex(b, indexName, opts.verifier)
+	if err != nil {
+		utils.Fatal("Error reading snapshot index %s: %v", indexName, err)
+	}
+	if err := checkChain(file, index.Chain); err != nil {
+		utils.Fatal("Invalid snapshot index %s: %v", indexName, err)
+	}
+	utils.Info("Restoring %s backup %s, %d archive(s) to replay", index.Mode, file, len(index.Chain))
+	for _, archive := range index.Chain {
+		// Archives rekeyed with another encryption are renamed, the chain keeps their original names
+		archive = resolveName(b, archive)
+		restoreArchive(b, archive, opts)
+		if trimEncryptionExtension(archive) == trimEncryptionExtension(file) {
+			applyTombstones(index.Deleted, opts)
+			continue
+		}
+		// Tombstones of intermediate backups are read from their own index
+		name := snapshotIndexName(archive)
+		if ext := encryptionExtension(archive); ext != "" {
+			name = resolveName(b, fmt.Sprintf("%s.%s", name, ext))
+		}
+		err := download(b, name)
+		var step *snapshotIndex
+		if err == nil {
+			step, err = readSignedSnapshotIndex(b, name, opts.verifier)
+		}
+		if err != nil {
+			utils.Fatal("Error reading snapshot index %s, error %v", name, err)
+		}
+		applyTombstones(step.Deleted, opts)
+	}
+}
+
+// checkChain checks the archives of a snapshot chain, they are stored next to the backup and share its prefix
+func checkChain(file string, chain []string) error {
+	prefix := backupPrefix(file)
+	for _, archive := range chain {
+		if archive == "" || filepath.Base(archive) != archive || archive == "." || archive == ".." {
+			return fmt.Errorf("invalid archive name %q in the chain", archive)
+		}
+		if archive != file && (prefix == "" || backupPrefix(archive) != prefix) {
+			return fmt.Errorf("archive %s of the chain does not have the prefix of %s", archive, file)
+		}
+	}
+	return nil
+}
+
+// restoreArchive restores an archive streamed from the storage, split archives are restored from their volumes
+func restoreArchive(b backend, archive string, opts restoreOptions) {
+	// The signature is checked before anything is read from the archive
+	signature, err := opts.verifier.fetch(b, archive)
+	if err != nil {
+		utils.Fatal("Error checking the signature of %s: %v", archive, err)
+	}
+	opts.signature = signature
+	if manifest, err := downloadPartsManifest(b, archive); err == nil {
+		restoreParts(b.Get, manifest, opts)
+		return
+	}
+	stream, err := b.Get(archive)
+	if err != nil {
+		utils.Fatal("Error opening %s: %v", archive, err)
+	}
+	defer stream.Close()
+	RestoreData(archive, stream, opts)
+}
+
+// readSignedSnapshotIndex checks the signature of an index downloaded to the temp directory, then reads it
+func readSignedSnapshotIndex(b backend, name string, v *signatureVerifier) (*snapshotIndex, error) {
+	if err := v.checkTempFile(b, name); err != nil {
+		return nil, err
+	}
+	return readSnapshotIndex(name)
+}
+
+// copyFromStorage downloads a file to the temp directory
+func copyFromStorage(b backend, file string) {
+	err := download(b, file)
+	if err != nil {
+		utils.Fatal("Error copying file, error %v", err)
+	}
+}
+
+// applyTombstones deletes the paths removed from the volume since the previous backup,
+// only the paths selected by the restore members and patterns are deleted
+func applyTombstones(deleted []string, opts restoreOptions) {
+	e := newExtractor(opts)
+	for _, path := range deleted {
+		// Deleting through a symlink could remove files outside the data path
+		target, err := e.safePath(path)
+		isDir := false
+		if err == nil {
+			info, statErr := os.Lstat(target)
+			isDir = statErr == nil && info.IsDir()
+		}
+		if !e.selected(path, isDir) {
+			continue
+		}
+		if err != nil || target == e.root {
+			utils.Warn("Skipping invalid deleted path %s", path)
+			continue
+		}
+		if opts.plan != nil {
+			opts.plan.remove(path, target)
+			continue
+		}
+		if err := os.RemoveAll(target); err != nil {
+			utils.Error("Error deleting %s: %v", target, err)
+		}
+		if opts.removed != nil {
+			opts.removed[path] = true
+		}
+	}
+	if len(deleted) > 0 && opts.plan == nil {
+		utils.Info("%d deleted path(s) removed", len(deleted))
+	}
+}
@@ -0,0 +1,167 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"fmt"
+	"github.com/jkaninda/volume-backup/utils"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// sourceNamePattern restricts source names, they are used in backup names and storage paths
+var sourceNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// backupSource is a folder under the data path backed up as its own artifact
+type backupSource struct {
+	Name string `yaml:"name"`
+	// Path is relative to the data path, eg: app for /data/app
+	Path string `yaml:"path"`
+	// Prefix of the backup names, the source name by default
+	Prefix string `yaml:"prefix"`
+	// RetentionDays overrides BACKUP_RETENTION_DAYS for this source
+	RetentionDays int `yaml:"retentionDays"`
+}
+
+// backupConfigFile is the YAML configuration file set with --config or BACKUP_CONFIG_FILE
+type backupConfigFile struct {
+	Sources  []backupSource  `yaml:"sources"`
+	Storages []backupStorage `yaml:"storages"`
+}
+
+// readConfigFile reads the configuration file, it is empty when no file is set
+func readConfigFile(cmd *cobra.Command) (*backupConfigFile, error) {
+	conf := &backupConfigFile{}
+	configFile := utils.GetEnv(cmd, "config", "BACKUP_CONFIG_FILE")
+	if configFile == "" {
+		return conf, nil
+	}
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading configuration file: %w", err)
+	}
+	if err := yaml.Unmarshal(data, conf); err != nil {
+		return nil, fmt.Errorf("invalid configuration file %s: %w", configFile, err)
+	}
+	return conf, nil
+}
+
+// loadSources reads the sources from the configuration file, BACKUP_SOURCES and the name=path values of the --source flags
+func loadSources(conf *backupConfigFile, values []string) ([]backupSource, error) {
+	sources := append([]backupSource{}, conf.Sources...)
+	for _, value := range append(splitEnv("BACKUP_SOURCES"), values...) {
+		source, err := parseSource(value)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	names := make(map[string]bool)
+	for i := range sources {
+		source := &sources[i]
+		if !sourceNamePattern.MatchString(source.Name) {
+			return nil, fmt.Errorf("invalid source name %q", source.Name)
+		}
+		if names[source.Name] {
+			return nil, fmt.Errorf("duplicate source %s", source.Name)
+		}
+		names[source.Name] = true
+		if source.Path == "" {
+			source.Path = source.Name
+		}
+		name, ok := memberPath(source.Path)
+		if !ok {
+			return nil, fmt.Errorf("source %s path %s is not inside %s", source.Name, source.Path, dataPath)
+		}
+		source.Path = name
+		if source.Prefix == "" {
+			source.Prefix = source.Name
+		}
+	}
+	return sources, nil
+}
+
+// parseSource parses a name=path source, the path defaults to the name
+func parseSource(value string) (backupSource, error) {
+	name, sourcePath, _ := strings.Cut(value, "=")
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return backupSource{}, fmt.Errorf("invalid source %q, expected name=path", value)
+	}
+	return backupSource{Name: name, Path: strings.TrimSpace(sourcePath)}, nil
+}
+
+// findSource returns the source of the given name
+func findSource(sources []backupSource, name string) (backupSource, error) {
+	for _, source := range sources {
+		if source.Name == name {
+			return source, nil
+		}
+	}
+	return backupSource{}, fmt.Errorf("source %s not found", name)
+}
+
+// resolveSource returns a source of the configuration file or BACKUP_SOURCES,
+// sources not defined in the configuration are folders named after them, with the same prefix
+func resolveSource(cmd *cobra.Command, name string) backupSource {
+	configFile, err := readConfigFile(cmd)
+	if err != nil {
+		utils.Fatal("Error loading configuration: %v", err)
+	}
+	sources, err := loadSources(configFile, nil)
+	if err != nil {
+		utils.Fatal("Error loading sources: %v", err)
+	}
+	source, err := findSource(sources, name)
+	if err != nil {
+		if !sourceNamePattern.MatchString(name) {
+			utils.Fatal("Invalid source name %s", name)
+		}
+		return backupSource{Name: name, Path: name, Prefix: name}
+	}
+	return source
+}
+
+// sourceConfig returns the backup configuration of a source.
+// Each source is stored in its own directory, so that its retention only applies to its backups.
+func sourceConfig(config *BackupConfig, source backupSource) *BackupConfig {
+	c := *config
+	c.sources = nil
+	c.source = source.Name
+	c.sourcePath = filepath.Join(dataPath, source.Path)
+	c.prefix = source.Prefix
+	if source.RetentionDays > 0 {
+		c.backupRetention = source.RetentionDays
+	}
+	return &c
+}
+
+// backupSources backs up each source as a separate artifact, a missing or failed source is reported and skipped
+func backupSources(config *BackupConfig) error {
+	failed := 0
+	for _, source := range config.sources {
+		utils.Info("Backing up source %s from %s ...", source.Name, filepath.Join(dataPath, source.Path))
+		if _, err := os.Stat(filepath.Join(dataPath, source.Path)); err != nil {
+			failed++
+			utils.Error("Error backing up source %s: %v", source.Name, err)
+			utils.NotifyError(fmt.Sprintf("Error backing up source %s: %v", source.Name, err))
+			continue
+		}
+		if err := BackupTask(sourceConfig(config, source)); err != nil {
+			failed++
+			utils.Error("Error backing up source %s: %v", source.Name, err)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d source(s) failed", failed, len(config.sources))
+	}
+	return nil
+}
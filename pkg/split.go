@@ -0,0 +1,235 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/jkaninda/volume-backup/utils"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// archivePart is a fixed-size volume of a split archive
+type archivePart struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// partsManifest lists the volumes of a split archive, it is stored next to them
+type partsManifest struct {
+	Archive  string        `json:"archive"`
+	Size     int64         `json:"size"`
+	SHA256   string        `json:"sha256"`
+	PartSize int64         `json:"partSize"`
+	Parts    []archivePart `json:"parts"`
+}
+
+// partsManifestName returns the manifest name of a split archive
+func partsManifestName(archive string) string {
+	return fmt.Sprintf("%s.parts.json", archive)
+}
+
+// partName returns the name of a volume of a split archive, starting from 1
+func partName(archive string, n int) string {
+	return fmt.Sprintf("%s.part%03d", archive, n)
+}
+
+// copyArchive uploads a backup archive from the temp directory to every storage, split into volumes when a split size is set.
+// The signature is uploaded once the archive is.
+func copyArchive(dests destinations, config *BackupConfig, finalFileName string) error {
+	var err error
+	if config.splitSize <= 0 {
+		err = dests.Put(finalFileName)
+		if err == nil {
+			err = dests.each(func(d *destination) error {
+				return checkUpload(d.backend, finalFileName)
+			})
+		}
+	} else {
+		err = uploadParts(dests, finalFileName, config.splitSize)
+	}
+	if err != nil {
+		return err
+	}
+	return uploadSignature(dests, config.signer, finalFileName)
+}
+
+// uploadParts splits an archive into volumes and uploads them one by one followed by the manifest,
+// only one volume is written to the temp directory at a time
+func uploadParts(u uploader, archive string, partSize int64) error {
+	file, err := os.Open(filepath.Join(tmpPath, archive))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	manifest := partsManifest{Archive: archive, PartSize: partSize}
+	archiveHash := sha256.New()
+	for n := 1; ; n++ {
+		part := archivePart{Name: partName(archive, n)}
+		part.Size, part.SHA256, err = writePart(io.TeeReader(file, archiveHash), part.Name, partSize)
+		if err != nil {
+			return err
+		}
+		if part.Size == 0 && n > 1 {
+			_ = os.Remove(filepath.Join(tmpPath, part.Name))
+			break
+		}
+		utils.Info("Uploading volume %s (%d bytes) ...", part.Name, part.Size)
+		if err := u.Put(part.Name); err != nil {
+			return fmt.Errorf("error uploading %s: %w", part.Name, err)
+		}
+		_ = os.Remove(filepath.Join(tmpPath, part.Name))
+		manifest.Parts = append(manifest.Parts, part)
+		manifest.Size += part.Size
+		if part.Size < partSize {
+			break
+		}
+	}
+	manifest.SHA256 = hex.EncodeToString(archiveHash.Sum(nil))
+	utils.Info("Backup split into %d volume(s)", len(manifest.Parts))
+	return uploadPartsManifest(u, &manifest)
+}
+
+// uploadPartsManifest uploads the manifest of a split archive, once all its volumes are uploaded
+func uploadPartsManifest(u uploader, manifest *partsManifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	name := partsManifestName(manifest.Archive)
+	if err := os.WriteFile(filepath.Join(tmpPath, name), data, 0600); err != nil {
+		return err
+	}
+	return u.Put(name)
+}
+
+// writePart writes up to size bytes to a volume in the temp directory, it returns its size and hash
+func writePart(reader io.Reader, name string, size int64) (int64, string, error) {
+	out, err := os.Create(filepath.Join(tmpPath, name))
+	if err != nil {
+		return 0, "", err
+	}
+	h := sha256.New()
+	n, err := io.CopyN(io.MultiWriter(out, h), reader, size)
+	if err != nil && err != io.EOF {
+		out.Close()
+		return 0, "", err
+	}
+	if err := out.Close(); err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// downloadPartsManifest downloads the manifest of a split archive
+func downloadPartsManifest(b backend, archive string) (*partsManifest, error) {
+	name := partsManifestName(archive)
+	if err := download(b, name); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(tmpPath, name))
+	if err != nil {
+		return nil, err
+	}
+	manifest := &partsManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", name, err)
+	}
+	return manifest, nil
+}
+
+// partsReader reads the volumes of a split archive as a single stream.
+// Each volume is streamed from the storage when it is reached, and checked once it is read.
+type partsReader struct {
+	open        func(string) (io.ReadCloser, error)
+	manifest    *partsManifest
+	next        int
+	current     io.ReadCloser
+	part        archivePart
+	partHash    hash.Hash
+	archiveHash hash.Hash
+}
+
+func newPartsReader(open func(string) (io.ReadCloser, error), manifest *partsManifest) *partsReader {
+	return &partsReader{open: open, manifest: manifest, archiveHash: sha256.New()}
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if r.next == len(r.manifest.Parts) {
+				if hex.EncodeToString(r.archiveHash.Sum(nil)) != r.manifest.SHA256 {
+					return 0, fmt.Errorf("checksum mismatch for %s", r.manifest.Archive)
+				}
+				return 0, io.EOF
+			}
+			if err := r.openPart(r.manifest.Parts[r.next]); err != nil {
+				return 0, err
+			}
+			r.next++
+		}
+		n, err := r.current.Read(p)
+		r.partHash.Write(p[:n])
+		r.archiveHash.Write(p[:n])
+		if err == io.EOF {
+			if err := r.closePart(); err != nil {
+				return n, err
+			}
+			if n == 0 {
+				continue
+			}
+			return n, nil
+		}
+		return n, err
+	}
+}
+
+// openPart opens the stream of a volume
+func (r *partsReader) openPart(part archivePart) error {
+	utils.Info("Reading volume %s ...", part.Name)
+	stream, err := r.open(part.Name)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", part.Name, err)
+	}
+	r.current = stream
+	r.part = part
+	r.partHash = sha256.New()
+	return nil
+}
+
+// closePart closes the volume read and checks it
+func (r *partsReader) closePart() error {
+	r.current.Close()
+	r.current = nil
+	if hex.EncodeToString(r.partHash.Sum(nil)) != r.part.SHA256 {
+		return fmt.Errorf("checksum mismatch for %s, the volume is corrupted", r.part.Name)
+	}
+	return nil
+}
+
+// Close closes the volume being read
+func (r *partsReader) Close() error {
+	if r.current != nil {
+		r.current.Close()
+		r.current = nil
+	}
+	return nil
+}
+
+// restoreParts restores a split archive, it is extracted while the volumes are read
+func restoreParts(open func(string) (io.ReadCloser, error), manifest *partsManifest, opts restoreOptions) {
+	utils.Info("Restoring split backup %s, %d volume(s)", manifest.Archive, len(manifest.Parts))
+	reader := newPartsReader(open, manifest)
+	defer reader.Close()
+	RestoreData(manifest.Archive, reader, opts)
+}
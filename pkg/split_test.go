@@ -0,0 +1,144 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// splitVolumes splits data into volumes of partSize bytes, like uploadParts, and returns their manifest
+func splitVolumes(data []byte, partSize int) (*partsManifest, map[string][]byte) {
+	sum := sha256.Sum256(data)
+	manifest := &partsManifest{Archive: "backup.tar.gz", Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:]), PartSize: int64(partSize)}
+	volumes := make(map[string][]byte)
+	for n := 1; len(data) > 0; n++ {
+		size := min(partSize, len(data))
+		part := bytes.Clone(data[:size])
+		data = data[size:]
+		partSum := sha256.Sum256(part)
+		name := partName(manifest.Archive, n)
+		volumes[name] = part
+		manifest.Parts = append(manifest.Parts, archivePart{Name: name, Size: int64(size), SHA256: hex.EncodeToString(partSum[:])})
+	}
+	return manifest, volumes
+}
+
+func TestPartsReader(t *testing.T) {
+	data := randomBytes(6, 10000)
+	tests := []struct {
+		name    string
+		data    []byte
+		change  func(manifest *partsManifest, volumes map[string][]byte)
+		wantErr string
+	}{
+		{name: "several volumes", data: data},
+		{name: "single volume", data: data[:1000]},
+		{name: "empty archive", data: nil},
+		{
+			name: "corrupted volume",
+			data: data,
+			change: func(_ *partsManifest, volumes map[string][]byte) {
+				volumes["backup.tar.gz.part002"][10] ^= 0xff
+			},
+			wantErr: "checksum mismatch for backup.tar.gz.part002, the volume is corrupted",
+		},
+		{
+			name: "truncated volume",
+			data: data,
+			change: func(_ *partsManifest, volumes map[string][]byte) {
+				volumes["backup.tar.gz.part003"] = volumes["backup.tar.gz.part003"][:100]
+			},
+			wantErr: "checksum mismatch for backup.tar.gz.part003, the volume is corrupted",
+		},
+		{
+			name: "missing volume",
+			data: data,
+			change: func(_ *partsManifest, volumes map[string][]byte) {
+				delete(volumes, "backup.tar.gz.part002")
+			},
+			wantErr: "error opening backup.tar.gz.part002",
+		},
+		{
+			name: "volume missing from the manifest",
+			data: data,
+			change: func(manifest *partsManifest, _ map[string][]byte) {
+				manifest.Parts = manifest.Parts[:len(manifest.Parts)-1]
+			},
+			wantErr: "checksum mismatch for backup.tar.gz",
+		},
+		{
+			name: "volumes in the wrong order",
+			data: data,
+			change: func(manifest *partsManifest, _ map[string][]byte) {
+				manifest.Parts[0], manifest.Parts[1] = manifest.Parts[1], manifest.Parts[0]
+			},
+			wantErr: "checksum mismatch for backup.tar.gz",
+		},
+		{
+			name: "archive checksum mismatch",
+			data: data,
+			change: func(manifest *partsManifest, _ map[string][]byte) {
+				manifest.SHA256 = strings.Repeat("0", 64)
+			},
+			wantErr: "checksum mismatch for backup.tar.gz",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest, volumes := splitVolumes(tt.data, 4096)
+			if tt.change != nil {
+				tt.change(manifest, volumes)
+			}
+			open := func(name string) (io.ReadCloser, error) {
+				volume, ok := volumes[name]
+				if !ok {
+					return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+				}
+				return io.NopCloser(bytes.NewReader(volume)), nil
+			}
+			r := newPartsReader(open, manifest)
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Fatalf("Read() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.data) {
+				t.Errorf("read %d bytes, they do not match the archive of %d bytes", len(got), len(tt.data))
+			}
+		})
+	}
+}
+
+func TestPartNames(t *testing.T) {
+	tests := []struct {
+		got  string
+		want string
+	}{
+		{got: partName("backup.tar.gz", 1), want: "backup.tar.gz.part001"},
+		{got: partName("backup.tar.gz.gpg", 12), want: "backup.tar.gz.gpg.part012"},
+		{got: partName("backup.tar.gz", 1000), want: "backup.tar.gz.part1000"},
+		{got: partsManifestName("backup.tar.gz.age"), want: "backup.tar.gz.age.parts.json"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("got %q, want %q", tt.got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"fmt"
+	goStorage "github.com/jkaninda/go-storage/pkg"
+	"github.com/jkaninda/volume-backup/utils"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backend stores the files of a storage directory, they are addressed by their name in the directory.
+// Backups, restores, verifications and rekeys only go through it, a new storage is added by registering its backend.
+type backend interface {
+	// Put uploads a file of the temp directory
+	Put(name string) error
+	// Get opens a stored file for reading, it is streamed without being downloaded first
+	Get(name string) (io.ReadCloser, error)
+	// List lists the stored files, subdirectories are not listed
+	List() ([]storedFile, error)
+	// Delete deletes a stored file
+	Delete(name string) error
+	// Stat returns the size and modification time of a stored file
+	Stat(name string) (storedFile, error)
+	// Rename renames a stored file, an existing file with the new name is replaced
+	Rename(oldName, newName string) error
+	// MakeDir creates the storage directory if it does not exist
+	MakeDir() error
+	// Location returns where a stored file is, it is reported in notifications
+	Location(name string) string
+}
+
+// uploader uploads files of the temp directory, to a backend or to every storage of a backup
+type uploader interface {
+	Put(name string) error
+}
+
+// backendType creates the backends of a storage
+type backendType struct {
+	// basePath returns the directory backups are stored in, remotePath is the REMOTE_PATH environment variable
+	basePath func(remotePath string) string
+	// open creates the backend of a storage directory
+	open func(dir string) (backend, error)
+}
+
+// backendTypes are the registered storages, keyed by the --storage value
+var backendTypes = make(map[string]backendType)
+
+// registerBackend registers a storage under its --storage values
+func registerBackend(t backendType, names ...string) {
+	for _, name := range names {
+		backendTypes[name] = t
+	}
+}
+
+// storageNames returns the registered --storage values
+func storageNames() []string {
+	names := make([]string, 0, len(backendTypes))
+	for name := range backendTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupBackend returns the registered storage of a --storage value
+func lookupBackend(storageType string) (backendType, error) {
+	t, ok := backendTypes[storageType]
+	if !ok {
+		return backendType{}, fmt.Errorf("unsupported storage %q, supported storages: %s", storageType, strings.Join(storageNames(), ", "))
+	}
+	return t, nil
+}
+
+// newBackend creates the backend of a storage, backups of a source are stored in a subdirectory named after it
+func newBackend(storageType, remotePath, source string) (backend, error) {
+	t, err := lookupBackend(storageType)
+	if err != nil {
+		return nil, err
+	}
+	return t.open(path.Join(t.basePath(remotePath), source))
+}
+
+// openBackend creates the backend of a storage, the program exits if it cannot be created
+func openBackend(storageType, remotePath, source string) backend {
+	b, err := newBackend(storageType, remotePath, source)
+	if err != nil {
+		utils.Fatal("Error creating %s storage: %v", storageType, err)
+	}
+	return b
+}
+
+// storedFile is a file of a storage directory
+type storedFile struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// putWith uploads a file of the temp directory with a go-storage storage
+func putWith(newStorage func() (goStorage.Storage, error), name string) error {
+	st, err := newStorage()
+	if err != nil {
+		return err
+	}
+	return st.Copy(name)
+}
+
+// resolveName returns the stored name of an encrypted file referenced by a snapshot index or a repository snapshot.
+// Rekeying to another encryption renames the files, a missing file is looked up with the other encryption extension.
+func resolveName(b backend, name string) string {
+	if encryptionExtension(name) == "" || storedExists(b, name) {
+		return name
+	}
+	for _, ext := range []string{gpgExtension, ageExtension} {
+		renamed := fmt.Sprintf("%s.%s", trimEncryptionExtension(name), ext)
+		if renamed != name && storedExists(b, renamed) {
+			return renamed
+		}
+	}
+	return name
+}
+
+// storedExists reports whether a file or a split archive is stored
+func storedExists(b backend, name string) bool {
+	if _, err := b.Stat(name); err == nil {
+		return true
+	}
+	_, err := b.Stat(partsManifestName(name))
+	return err == nil
+}
+
+// download copies a stored file to the temp directory
+func download(b backend, name string) error {
+	stream, err := b.Get(name)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	out, err := os.Create(filepath.Join(tmpPath, name))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, stream); err != nil {
+		out.Close()
+		_ = os.Remove(filepath.Join(tmpPath, name))
+		return err
+	}
+	return out.Close()
+}
+
+// checkUpload compares the size of an uploaded file with the file of the temp directory
+func checkUpload(b backend, name string) error {
+	info, err := os.Stat(filepath.Join(tmpPath, name))
+	if err != nil {
+		return err
+	}
+	stored, err := b.Stat(name)
+	if err != nil {
+		return fmt.Errorf("error reading uploaded file %s: %w", name, err)
+	}
+	if stored.size != info.Size() {
+		return fmt.Errorf("%s is incomplete, %d of %d bytes uploaded", name, stored.size, info.Size())
+	}
+	return nil
+}
+
+// pruneBackend deletes the stored files older than the retention days.
+// The archives of incremental and differential chains are kept as long as a retained backup is restored from them,
+// repository files are never deleted.
+func pruneBackend(b backend, retentionDays int) error {
+	files, err := b.List()
+	if err != nil {
+		return err
+	}
+	limit := time.Now().AddDate(0, 0, -retentionDays)
+	chained, err := chainedArchives(b, files, limit)
+	if err != nil {
+		return fmt.Errorf("no file deleted, %w", err)
+	}
+	deleted, kept := 0, 0
+	for _, file := range files {
+		if !file.modTime.Before(limit) || isRepositoryFile(file.name) {
+			continue
+		}
+		if inChain(file.name, chained) {
+			kept++
+			continue
+		}
+		if err := b.Delete(file.name); err != nil {
+			return fmt.Errorf("error deleting %s: %w", file.name, err)
+		}
+		deleted++
+	}
+	utils.Info("%d file(s) older than %d days deleted", deleted, retentionDays)
+	if kept > 0 {
+		utils.Info("%d older file(s) kept, retained backups are restored from them", kept)
+	}
+	return nil
+}
+
+// remoteReader is a stream of a remote file, closing it closes the connection
+type remoteReader struct {
+	io.Reader
+	close func()
+}
+
+func (r *remoteReader) Close() error {
+	r.close()
+	return nil
+}
@@ -0,0 +1,170 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"fmt"
+	goStorage "github.com/jkaninda/go-storage/pkg"
+	"github.com/jkaninda/go-storage/pkg/ftp"
+	ftpclient "github.com/jlaffaye/ftp"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerBackend(backendType{
+		basePath: func(remotePath string) string { return remotePath },
+		open: func(dir string) (backend, error) {
+			ftpConfig, err := loadFTPConfig()
+			if err != nil {
+				return nil, fmt.Errorf("error loading ftp config: %w", err)
+			}
+			return &ftpBackend{dir: dir, config: ftpConfig}, nil
+		},
+	}, "ftp")
+}
+
+// ftpBackend stores backups in a directory of a FTP server.
+// The connection is closed after each transfer, a new one is opened for every operation.
+type ftpBackend struct {
+	dir    string
+	config *FTPConfig
+}
+
+func (f *ftpBackend) Put(name string) error {
+	return putWith(func() (goStorage.Storage, error) {
+		return ftp.NewStorage(ftp.Config{
+			Host:       f.config.host,
+			Port:       f.config.port,
+			User:       f.config.user,
+			Password:   f.config.password,
+			RemotePath: f.dir,
+			LocalPath:  tmpPath,
+		})
+	}, name)
+}
+
+func (f *ftpBackend) Get(name string) (io.ReadCloser, error) {
+	client, err := f.dial()
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.Retr(path.Join(f.dir, name))
+	if err != nil {
+		_ = client.Quit()
+		return nil, err
+	}
+	return &remoteReader{Reader: response, close: func() {
+		_ = response.Close()
+		_ = client.Quit()
+	}}, nil
+}
+
+func (f *ftpBackend) List() ([]storedFile, error) {
+	client, err := f.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Quit()
+	entries, err := client.List(f.dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []storedFile
+	for _, entry := range entries {
+		if entry.Type != ftpclient.EntryTypeFile {
+			continue
+		}
+		files = append(files, storedFile{name: entry.Name, size: int64(entry.Size), modTime: entry.Time})
+	}
+	return files, nil
+}
+
+func (f *ftpBackend) Delete(name string) error {
+	client, err := f.dial()
+	if err != nil {
+		return err
+	}
+	defer client.Quit()
+	return client.Delete(path.Join(f.dir, name))
+}
+
+// Stat reads the file from the directory listing, servers do not all support MLST
+func (f *ftpBackend) Stat(name string) (storedFile, error) {
+	files, err := f.List()
+	if err != nil {
+		return storedFile{}, err
+	}
+	for _, file := range files {
+		if file.name == name {
+			return file, nil
+		}
+	}
+	return storedFile{}, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+}
+
+func (f *ftpBackend) Rename(oldName, newName string) error {
+	client, err := f.dial()
+	if err != nil {
+		return err
+	}
+	defer client.Quit()
+	oldPath, newPath := path.Join(f.dir, oldName), path.Join(f.dir, newName)
+	err = client.Rename(oldPath, newPath)
+	if err == nil {
+		return nil
+	}
+	// Servers do not all replace an existing file on rename, it is moved aside until the file is renamed
+	aside := newPath + ".old"
+	if asideErr := client.Rename(newPath, aside); asideErr != nil {
+		return err
+	}
+	if err := client.Rename(oldPath, newPath); err != nil {
+		_ = client.Rename(aside, newPath)
+		return err
+	}
+	return client.Delete(aside)
+}
+
+// MakeDir creates the directory and its parents
+func (f *ftpBackend) MakeDir() error {
+	client, err := f.dial()
+	if err != nil {
+		return err
+	}
+	defer client.Quit()
+	current := ""
+	if strings.HasPrefix(f.dir, "/") {
+		current = "/"
+	}
+	for _, part := range strings.Split(strings.Trim(f.dir, "/"), "/") {
+		current = path.Join(current, part)
+		// Existing directories return an error, it is checked once all directories are created
+		_ = client.MakeDir(current)
+	}
+	return client.ChangeDir(f.dir)
+}
+
+func (f *ftpBackend) Location(name string) string {
+	return fmt.Sprintf("ftp://%s%s", f.config.host, path.Join("/", f.dir, name))
+}
+
+// dial connects and logs in to the FTP server
+func (f *ftpBackend) dial() (*ftpclient.ServerConn, error) {
+	client, err := ftpclient.Dial(fmt.Sprintf("%s:%d", f.config.host, f.config.port), ftpclient.DialWithTimeout(30*time.Second))
+	if err != nil {
+		return nil, err
+	}
+	if err = client.Login(f.config.user, f.config.password); err != nil {
+		_ = client.Quit()
+		return nil, err
+	}
+	return client, nil
+}
@@ -0,0 +1,79 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	goStorage "github.com/jkaninda/go-storage/pkg"
+	"github.com/jkaninda/go-storage/pkg/local"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+func init() {
+	registerBackend(backendType{
+		basePath: func(string) string { return backupDestination },
+		open: func(dir string) (backend, error) {
+			return &localBackend{dir: dir}, nil
+		},
+	}, "local")
+}
+
+// localBackend stores backups in a local directory, usually a mounted volume
+type localBackend struct {
+	dir string
+}
+
+func (l *localBackend) Put(name string) error {
+	return putWith(func() (goStorage.Storage, error) {
+		return local.NewStorage(local.Config{LocalPath: tmpPath, RemotePath: l.dir}), nil
+	}, name)
+}
+
+func (l *localBackend) Get(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(l.dir, name))
+}
+
+func (l *localBackend) List() ([]storedFile, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []storedFile
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, storedFile{name: entry.Name(), size: info.Size(), modTime: info.ModTime()})
+	}
+	return files, nil
+}
+
+func (l *localBackend) Delete(name string) error {
+	return os.Remove(filepath.Join(l.dir, name))
+}
+
+func (l *localBackend) Stat(name string) (storedFile, error) {
+	info, err := os.Stat(filepath.Join(l.dir, name))
+	if err != nil {
+		return storedFile{}, err
+	}
+	return storedFile{name: name, size: info.Size(), modTime: info.ModTime()}, nil
+}
+
+func (l *localBackend) Rename(oldName, newName string) error {
+	return os.Rename(filepath.Join(l.dir, oldName), filepath.Join(l.dir, newName))
+}
+
+func (l *localBackend) MakeDir() error {
+	return os.MkdirAll(l.dir, 0755)
+}
+
+func (l *localBackend) Location(name string) string {
+	return filepath.Join(l.dir, name)
+}
@@ -0,0 +1,213 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/jkaninda/volume-backup/utils"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	registerBackend(backendType{
+		basePath: func(remotePath string) string { return remotePath },
+		open:     newS3Backend,
+	}, "s3")
+}
+
+// s3Backend stores backups in a bucket, under the prefix of the storage directory
+type s3Backend struct {
+	dir    string
+	config *AWSConfig
+	client *awss3.S3
+}
+
+// newS3Backend creates the S3 client of a storage directory from the AWS configuration
+func newS3Backend(dir string) (backend, error) {
+	awsConfig, err := loadAWSConfig()
+	if err != nil {
+		return nil, err
+	}
+	sess, err := session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials(awsConfig.accessKey, awsConfig.secretKey, ""),
+		Endpoint:         aws.String(awsConfig.endpoint),
+		Region:           aws.String(awsConfig.region),
+		DisableSSL:       aws.Bool(awsConfig.disableSsl),
+		S3ForcePathStyle: aws.Bool(awsConfig.forcePathStyle),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3Backend{dir: dir, config: awsConfig, client: awss3.New(sess)}, nil
+}
+
+// key returns the object key of a stored file, keys always use slashes
+func (s *s3Backend) key(name string) string {
+	return path.Join(s.dir, name)
+}
+
+// Put uploads a file of the temp directory, large files are uploaded in parts
+func (s *s3Backend) Put(name string) error {
+	file, err := os.Open(filepath.Join(tmpPath, name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = s3manager.NewUploaderWithClient(s.client).Upload(&s3manager.UploadInput{
+		Bucket: aws.String(s.config.bucket),
+		Key:    aws.String(s.key(name)),
+		Body:   file,
+	})
+	return err
+}
+
+func (s *s3Backend) Get(name string) (io.ReadCloser, error) {
+	output, err := s.client.GetObject(&awss3.GetObjectInput{
+		Bucket: aws.String(s.config.bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.Body, nil
+}
+
+// List lists the objects under the prefix, objects of deeper prefixes are not listed
+func (s *s3Backend) List() ([]storedFile, error) {
+	prefix := strings.TrimSuffix(s.key("x"), "x")
+	var files []storedFile
+	err := s.client.ListObjectsV2Pages(&awss3.ListObjectsV2Input{
+		Bucket: aws.String(s.config.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *awss3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			name := strings.TrimPrefix(aws.StringValue(object.Key), prefix)
+			if name == "" || strings.Contains(name, "/") {
+				continue
+			}
+			files = append(files, storedFile{name: name, size: aws.Int64Value(object.Size), modTime: aws.TimeValue(object.LastModified)})
+		}
+		return true
+	})
+	return files, err
+}
+
+func (s *s3Backend) Delete(name string) error {
+	_, err := s.client.DeleteObject(&awss3.DeleteObjectInput{
+		Bucket: aws.String(s.config.bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	return err
+}
+
+func (s *s3Backend) Stat(name string) (storedFile, error) {
+	output, err := s.client.HeadObject(&awss3.HeadObjectInput{
+		Bucket: aws.String(s.config.bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	if err != nil {
+		return storedFile{}, err
+	}
+	return storedFile{name: name, size: aws.Int64Value(output.ContentLength), modTime: aws.TimeValue(output.LastModified)}, nil
+}
+
+// maxCopySize is the largest object copied with a single request, larger objects are copied in parts
+const maxCopySize = 5 << 30
+
+// copyPartSize is the size of the parts of a multipart copy, it grows to stay below the 10000 parts limit
+const copyPartSize = 512 << 20
+
+// Rename copies the object to its new key and deletes it, S3 has no rename
+func (s *s3Backend) Rename(oldName, newName string) error {
+	info, err := s.Stat(oldName)
+	if err != nil {
+		return err
+	}
+	source := (&url.URL{Path: path.Join(s.config.bucket, s.key(oldName))}).EscapedPath()
+	if info.size > maxCopySize {
+		err = s.copyParts(source, newName, info.size)
+	} else {
+		_, err = s.client.CopyObject(&awss3.CopyObjectInput{
+			Bucket:     aws.String(s.config.bucket),
+			CopySource: aws.String(source),
+			Key:        aws.String(s.key(newName)),
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return s.Delete(oldName)
+}
+
+// copyParts copies an object larger than a single copy allows with a multipart upload, the upload is aborted on error
+func (s *s3Backend) copyParts(source, newName string, size int64) error {
+	upload, err := s.client.CreateMultipartUpload(&awss3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.config.bucket),
+		Key:    aws.String(s.key(newName)),
+	})
+	if err != nil {
+		return err
+	}
+	partSize := max(int64(copyPartSize), (size+9999)/10000)
+	var parts []*awss3.CompletedPart
+	for offset, n := int64(0), int64(1); offset < size; offset, n = offset+partSize, n+1 {
+		output, err := s.client.UploadPartCopy(&awss3.UploadPartCopyInput{
+			Bucket:          aws.String(s.config.bucket),
+			Key:             aws.String(s.key(newName)),
+			UploadId:        upload.UploadId,
+			PartNumber:      aws.Int64(n),
+			CopySource:      aws.String(source),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, min(offset+partSize, size)-1)),
+		})
+		if err != nil {
+			s.abortUpload(newName, upload.UploadId)
+			return fmt.Errorf("error copying part %d of %s: %w", n, newName, err)
+		}
+		parts = append(parts, &awss3.CompletedPart{ETag: output.CopyPartResult.ETag, PartNumber: aws.Int64(n)})
+	}
+	_, err = s.client.CompleteMultipartUpload(&awss3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.config.bucket),
+		Key:             aws.String(s.key(newName)),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &awss3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		s.abortUpload(newName, upload.UploadId)
+	}
+	return err
+}
+
+// abortUpload aborts a multipart upload, its parts are deleted
+func (s *s3Backend) abortUpload(name string, uploadID *string) {
+	_, err := s.client.AbortMultipartUpload(&awss3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.config.bucket),
+		Key:      aws.String(s.key(name)),
+		UploadId: uploadID,
+	})
+	if err != nil {
+		utils.Warn("Error aborting the copy of %s: %v", name, err)
+	}
+}
+
+// MakeDir does nothing, S3 has no directories
+func (s *s3Backend) MakeDir() error {
+	return nil
+}
+
+func (s *s3Backend) Location(name string) string {
+	return fmt.Sprintf("s3://%s/%s", s.config.bucket, strings.TrimPrefix(s.key(name), "/"))
+}
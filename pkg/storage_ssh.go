@@ -0,0 +1,258 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/jkaninda/volume-backup/utils"
+	cryptossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerBackend(backendType{
+		basePath: func(remotePath string) string { return remotePath },
+		open:     newSSHBackend,
+	}, "ssh", "remote")
+}
+
+// sshBackend stores backups in a directory of a remote server, files are copied with remote shell commands
+type sshBackend struct {
+	dir    string
+	config *SSHConfig
+	// hostKey checks the host key of the server
+	hostKey cryptossh.HostKeyCallback
+}
+
+// newSSHBackend reads the SSH configuration, the server is connected to for each operation
+func newSSHBackend(dir string) (backend, error) {
+	sshConfig, err := loadSSHConfig()
+	if err != nil {
+		return nil, fmt.Errorf("error loading ssh config: %w", err)
+	}
+	hostKey, err := sshHostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+	return &sshBackend{dir: dir, config: sshConfig, hostKey: hostKey}, nil
+}
+
+// sshHostKeyCallback returns the host key check of the server, the key pinned by SSH_HOST_KEY or the known_hosts
+// file of SSH_KNOWN_HOSTS. Any host key is accepted when neither is set.
+func sshHostKeyCallback() (cryptossh.HostKeyCallback, error) {
+	hostKey, knownHosts := os.Getenv("SSH_HOST_KEY"), os.Getenv("SSH_KNOWN_HOSTS")
+	switch {
+	case hostKey != "" && knownHosts != "":
+		return nil, errors.New("only one of SSH_HOST_KEY and SSH_KNOWN_HOSTS can be set")
+	case hostKey != "":
+		key, _, _, _, err := cryptossh.ParseAuthorizedKey([]byte(hostKey))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing SSH_HOST_KEY: %w", err)
+		}
+		return cryptossh.FixedHostKey(key), nil
+	case knownHosts != "":
+		callback, err := knownhosts.New(knownHosts)
+		if err != nil {
+			return nil, fmt.Errorf("error reading SSH_KNOWN_HOSTS: %w", err)
+		}
+		return callback, nil
+	}
+	utils.Warn("The host key of the SSH server is not checked, set SSH_HOST_KEY or SSH_KNOWN_HOSTS")
+	return cryptossh.InsecureIgnoreHostKey(), nil
+}
+
+// Put copies a file of the temp directory to the remote server with cat
+func (s *sshBackend) Put(name string) error {
+	file, err := os.Open(filepath.Join(tmpPath, name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	client, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	session.Stdin = file
+	if output, err := session.CombinedOutput(fmt.Sprintf("cat > %s", shellQuote(path.Join(s.dir, name)))); err != nil {
+		return fmt.Errorf("error copying %s: %w: %s", name, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Get streams a file of the remote server with cat
+func (s *sshBackend) Get(name string) (io.ReadCloser, error) {
+	client, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	if err == nil {
+		err = session.Start(fmt.Sprintf("cat %s", shellQuote(path.Join(s.dir, name))))
+	}
+	if err != nil {
+		session.Close()
+		client.Close()
+		return nil, err
+	}
+	return &remoteReader{Reader: &sshReader{Reader: stdout, session: session, stderr: &stderr}, close: func() {
+		_ = session.Close()
+		_ = client.Close()
+	}}, nil
+}
+
+// sshReader is the output of a remote command, a failed command, eg: a missing file, is reported at its end
+type sshReader struct {
+	io.Reader
+	session *cryptossh.Session
+	stderr  *bytes.Buffer
+}
+
+func (r *sshReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		if waitErr := r.session.Wait(); waitErr != nil {
+			return n, fmt.Errorf("%w: %s", waitErr, strings.TrimSpace(r.stderr.String()))
+		}
+	}
+	return n, err
+}
+
+// List lists the files of the remote directory with find and stat
+func (s *sshBackend) List() ([]storedFile, error) {
+	output, err := s.output(fmt.Sprintf("find %s -maxdepth 1 -type f -exec stat -c '%%s %%Y %%n' {} +", shellQuote(s.dir)))
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s: %w", s.dir, err)
+	}
+	var files []storedFile
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if file, ok := parseStat(line); ok {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+func (s *sshBackend) Delete(name string) error {
+	return s.run(fmt.Sprintf("rm -f %s", shellQuote(path.Join(s.dir, name))))
+}
+
+func (s *sshBackend) Stat(name string) (storedFile, error) {
+	output, err := s.output(fmt.Sprintf("stat -c '%%s %%Y %%n' %s", shellQuote(path.Join(s.dir, name))))
+	if err != nil {
+		return storedFile{}, err
+	}
+	file, ok := parseStat(strings.TrimSpace(string(output)))
+	if !ok {
+		return storedFile{}, fmt.Errorf("invalid stat output for %s", name)
+	}
+	return file, nil
+}
+
+func (s *sshBackend) Rename(oldName, newName string) error {
+	return s.run(fmt.Sprintf("mv -f %s %s", shellQuote(path.Join(s.dir, oldName)), shellQuote(path.Join(s.dir, newName))))
+}
+
+func (s *sshBackend) MakeDir() error {
+	return s.run(fmt.Sprintf("mkdir -p %s", shellQuote(s.dir)))
+}
+
+func (s *sshBackend) Location(name string) string {
+	return fmt.Sprintf("%s:%s", s.config.hostName, path.Join(s.dir, name))
+}
+
+// parseStat parses a "size mtime path" line of stat
+func parseStat(line string) (storedFile, bool) {
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) != 3 {
+		return storedFile{}, false
+	}
+	size, _ := strconv.ParseInt(fields[0], 10, 64)
+	modTime, _ := strconv.ParseInt(fields[1], 10, 64)
+	return storedFile{name: path.Base(fields[2]), size: size, modTime: time.Unix(modTime, 0)}, true
+}
+
+// dial connects to the remote server, with the identity file or the password
+func (s *sshBackend) dial() (*cryptossh.Client, error) {
+	clientConfig := &cryptossh.ClientConfig{
+		User:            s.config.user,
+		HostKeyCallback: s.hostKey,
+		Timeout:         30 * time.Second,
+	}
+	if key, err := os.ReadFile(s.config.identifyFile); err == nil {
+		signer, err := cryptossh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing private key: %w", err)
+		}
+		clientConfig.Auth = []cryptossh.AuthMethod{cryptossh.PublicKeys(signer)}
+	} else {
+		if s.config.password == "" {
+			return nil, errors.New("ssh password required")
+		}
+		clientConfig.Auth = []cryptossh.AuthMethod{cryptossh.Password(s.config.password)}
+	}
+	return cryptossh.Dial("tcp", fmt.Sprintf("%s:%d", s.config.hostName, s.config.port), clientConfig)
+}
+
+// output runs a command on the remote server and returns its standard output
+func (s *sshBackend) output(command string) ([]byte, error) {
+	client, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	return session.Output(command)
+}
+
+// run runs a command on the remote server
+func (s *sshBackend) run(command string) error {
+	client, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	if output, err := session.CombinedOutput(command); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// shellQuote quotes a value for the remote shell, single quotes are escaped
+func shellQuote(value string) string {
+	return fmt.Sprintf("'%s'", strings.ReplaceAll(value, "'", `'\''`))
+}
@@ -0,0 +1,77 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	cryptossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// hostKey returns a new ed25519 SSH public key
+func hostKey(t *testing.T) cryptossh.PublicKey {
+	t.Helper()
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := cryptossh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestSSHHostKeyCallback(t *testing.T) {
+	serverKey, otherKey := hostKey(t), hostKey(t)
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize("backup.example.com:2222")}, serverKey)
+	if err := os.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pinned := string(cryptossh.MarshalAuthorizedKey(serverKey))
+	tests := []struct {
+		name       string
+		hostKey    string
+		knownHosts string
+		key        cryptossh.PublicKey
+		wantErr    bool
+		wantReject bool
+	}{
+		{name: "pinned key", hostKey: pinned, key: serverKey},
+		{name: "pinned key mismatch", hostKey: pinned, key: otherKey, wantReject: true},
+		{name: "known hosts", knownHosts: knownHosts, key: serverKey},
+		{name: "known hosts mismatch", knownHosts: knownHosts, key: otherKey, wantReject: true},
+		{name: "not checked", key: otherKey},
+		{name: "invalid pinned key", hostKey: "ssh-ed25519 invalid", wantErr: true},
+		{name: "missing known hosts", knownHosts: filepath.Join(t.TempDir(), "missing"), wantErr: true},
+		{name: "both set", hostKey: pinned, knownHosts: knownHosts, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SSH_HOST_KEY", tt.hostKey)
+			t.Setenv("SSH_KNOWN_HOSTS", tt.knownHosts)
+			callback, err := sshHostKeyCallback()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sshHostKeyCallback() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 2222}
+			err = callback("backup.example.com:2222", addr, tt.key)
+			if (err != nil) != tt.wantReject {
+				t.Errorf("host key check error = %v, wantReject %v", err, tt.wantReject)
+			}
+		})
+	}
+}
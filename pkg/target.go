@@ -0,0 +1,325 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"fmt"
+	"github.com/jkaninda/volume-backup/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Restore strategies, how the restored files are combined with the existing content of the target
+const (
+	// strategyMerge overwrites the restored files and keeps the other files of the target
+	strategyMerge = "merge"
+	// strategyClean empties the target, only the restored files are left
+	strategyClean = "clean"
+	// strategySkipExisting keeps the existing files, only the missing files are restored
+	strategySkipExisting = "skip-existing"
+	// strategyFailIfNotEmpty restores only to an empty target
+	strategyFailIfNotEmpty = "fail-if-not-empty"
+)
+
+// stagingPrefix is the name prefix of the staging directories, backups are extracted to a staging directory
+// inside the target, on the same file system, so that the restored files are moved in place with renames
+const stagingPrefix = ".volume-backup-restore-"
+
+// previousPrefix is the name prefix of the directory the replaced and removed entries of the target are moved to,
+// they are moved back if the restored files cannot be moved in place
+const previousPrefix = ".volume-backup-previous-"
+
+// isRestoreDir reports whether a directory name is a staging directory or the previous content of a restore,
+// they are never backed up nor restored
+func isRestoreDir(name string) bool {
+	return strings.HasPrefix(name, stagingPrefix) || strings.HasPrefix(name, previousPrefix)
+}
+
+// isValidStrategy reports whether a restore strategy is supported
+func isValidStrategy(strategy string) bool {
+	switch strategy {
+	case strategyMerge, strategyClean, strategySkipExisting, strategyFailIfNotEmpty:
+		return true
+	}
+	return false
+}
+
+// checkRestoreTarget fails if a restore target is the file system root or contains the backup directories,
+// the clean strategy would delete them
+func checkRestoreTarget(target string) error {
+	if !filepath.IsAbs(target) {
+		return fmt.Errorf("target %s is not an absolute path", target)
+	}
+	target = filepath.Clean(target)
+	if target == "/" {
+		return fmt.Errorf("cannot restore to /")
+	}
+	for _, dir := range []string{tmpPath, backupDestination, snapshotPath} {
+		if dir == target || strings.HasPrefix(dir, target+"/") {
+			return fmt.Errorf("cannot restore to %s, it contains %s", target, dir)
+		}
+	}
+	return nil
+}
+
+// prepareRestore checks the target of a restore and creates the staging directory the backup is extracted to.
+// Staging directories left by a failed restore are removed.
+func prepareRestore(conf *RestoreConfig) (string, error) {
+	if err := os.MkdirAll(conf.root, 0755); err != nil {
+		return "", err
+	}
+	leftovers, err := filepath.Glob(filepath.Join(conf.root, stagingPrefix+"*"))
+	if err != nil {
+		return "", err
+	}
+	for _, leftover := range leftovers {
+		utils.Info("Removing staging directory %s of a failed restore", leftover)
+		if err := os.RemoveAll(leftover); err != nil {
+			return "", err
+		}
+	}
+	// The previous content of the target is only left when a restore was interrupted, it is never deleted
+	previous, err := filepath.Glob(filepath.Join(conf.root, previousPrefix+"*"))
+	if err != nil {
+		return "", err
+	}
+	for _, leftover := range previous {
+		utils.Warn("Previous content of %s is kept in %s by an interrupted restore", conf.root, leftover)
+	}
+	if conf.strategy == strategyFailIfNotEmpty {
+		if err := checkEmptyTarget(conf.root); err != nil {
+			return "", err
+		}
+	}
+	staging, err := os.MkdirTemp(conf.root, stagingPrefix)
+	if err != nil {
+		return "", err
+	}
+	// The target metadata is kept unless the archive has an entry for its root
+	copyDirMetadata(conf.root, staging)
+	return staging, nil
+}
+
+// checkEmptyTarget fails if the target has files, a missing target is empty
+func checkEmptyTarget(target string) error {
+	entries, err := os.ReadDir(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		// lost+found is created by mkfs at the root of ext file systems
+		if entry.Name() != "lost+found" && !strings.HasPrefix(entry.Name(), stagingPrefix) {
+			return fmt.Errorf("target %s is not empty", target)
+		}
+	}
+	return nil
+}
+
+// commitRestore moves the extracted files from the staging directory to the target, according to the restore strategy.
+// The replaced and removed entries of the target are moved aside, every change is undone if the restore fails.
+func commitRestore(conf *RestoreConfig) error {
+	target := conf.root
+	j, err := newCommitJournal(target)
+	if err != nil {
+		return err
+	}
+	switch conf.strategy {
+	case strategyClean:
+		utils.Info("Moving the content of %s to %s ...", target, j.previous)
+		err = j.clear()
+	case strategyMerge:
+		err = j.removeDeleted(conf.staging, conf.removed)
+	}
+	if err == nil {
+		err = j.mergeTree(conf.staging, ".", conf.strategy == strategySkipExisting)
+	}
+	if err != nil {
+		return j.rollback(err)
+	}
+	if conf.strategy != strategySkipExisting {
+		copyDirMetadata(conf.staging, target)
+	}
+	if err := os.RemoveAll(j.previous); err != nil {
+		utils.Warn("Error removing the previous content of %s: %v", target, err)
+	}
+	return os.RemoveAll(conf.staging)
+}
+
+// commitJournal records the changes made to the target while the restored files are moved in place.
+// Replaced and removed entries are moved to the previous directory, inside the target, so that they are moved back
+// with renames if the restore fails.
+type commitJournal struct {
+	target   string
+	previous string
+	// added are the paths moved from the staging directory, relative to the target
+	added []string
+	// moved are the entries moved aside, in order
+	moved []movedEntry
+}
+
+// movedEntry is an entry of the target moved to the previous directory
+type movedEntry struct {
+	path  string
+	aside string
+}
+
+// newCommitJournal creates the previous directory of a restore
+func newCommitJournal(target string) (*commitJournal, error) {
+	previous, err := os.MkdirTemp(target, previousPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return &commitJournal{target: target, previous: previous}, nil
+}
+
+// moveAside moves an entry of the target to the previous directory, it keeps its name
+func (j *commitJournal) moveAside(rel string) error {
+	dir := filepath.Join(j.previous, strconv.Itoa(len(j.moved)))
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return err
+	}
+	aside := filepath.Join(dir, filepath.Base(rel))
+	if err := os.Rename(filepath.Join(j.target, rel), aside); err != nil {
+		return err
+	}
+	j.moved = append(j.moved, movedEntry{path: rel, aside: aside})
+	return nil
+}
+
+// add moves a restored entry in place
+func (j *commitJournal) add(src, rel string) error {
+	if err := os.Rename(src, filepath.Join(j.target, rel)); err != nil {
+		return err
+	}
+	j.added = append(j.added, rel)
+	return nil
+}
+
+// rollback undoes the changes made to the target and returns the restore error. The restored entries are removed
+// and the entries moved aside are moved back, the previous directory is kept if they cannot be.
+func (j *commitJournal) rollback(err error) error {
+	for i := len(j.added) - 1; i >= 0; i-- {
+		if rmErr := os.RemoveAll(filepath.Join(j.target, j.added[i])); rmErr != nil {
+			return fmt.Errorf("%w, the previous content of %s is kept in %s: %v", err, j.target, j.previous, rmErr)
+		}
+	}
+	for i := len(j.moved) - 1; i >= 0; i-- {
+		if mvErr := os.Rename(j.moved[i].aside, filepath.Join(j.target, j.moved[i].path)); mvErr != nil {
+			return fmt.Errorf("%w, the previous content of %s is kept in %s: %v", err, j.target, j.previous, mvErr)
+		}
+	}
+	utils.Warn("Restore failed, the previous content of %s is moved back", j.target)
+	_ = os.RemoveAll(j.previous)
+	return err
+}
+
+// clear moves the content of the target aside, except the staging directories and the previous content of
+// interrupted restores
+func (j *commitJournal) clear() error {
+	entries, err := os.ReadDir(j.target)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if isRestoreDir(entry.Name()) {
+			continue
+		}
+		if err := j.moveAside(entry.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeDeleted moves aside the paths deleted by the replayed incremental backups, unless they were restored again
+func (j *commitJournal) removeDeleted(staging string, removed map[string]bool) error {
+	paths := make([]string, 0, len(removed))
+	for path := range removed {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	// Paths are resolved like archive entries, a deleted path cannot remove files through a symlink
+	e := newExtractor(restoreOptions{root: j.target})
+	for _, path := range paths {
+		if _, err := os.Lstat(filepath.Join(staging, path)); err == nil {
+			continue
+		}
+		outputPath, err := e.safePath(path)
+		if err != nil || outputPath == e.root || outputPath == staging || outputPath == j.previous {
+			continue
+		}
+		if _, err := os.Lstat(outputPath); os.IsNotExist(err) {
+			continue
+		}
+		rel, _ := filepath.Rel(j.target, outputPath)
+		if err := j.moveAside(rel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeTree moves the content of a staging directory to the target with renames, rel is the path of the directory
+// in both. Existing directories are merged, other existing entries are moved aside and replaced, or kept when
+// skipExisting is set. Symlinks of the target are replaced, never followed.
+func (j *commitJournal) mergeTree(src, rel string, skipExisting bool) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		srcPath := filepath.Join(src, entry.Name())
+		entryRel := filepath.Join(rel, entry.Name())
+		dstInfo, err := os.Lstat(filepath.Join(j.target, entryRel))
+		if os.IsNotExist(err) {
+			if err := j.add(srcPath, entryRel); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() && dstInfo.IsDir() {
+			if err := j.mergeTree(srcPath, entryRel, skipExisting); err != nil {
+				return err
+			}
+			continue
+		}
+		if skipExisting {
+			continue
+		}
+		if err := j.moveAside(entryRel); err != nil {
+			return err
+		}
+		if err := j.add(srcPath, entryRel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyDirMetadata copies the owner, permissions and modification time of a directory to another one
+func copyDirMetadata(src, dst string) {
+	info, err := os.Lstat(src)
+	if err != nil {
+		utils.Warn("Error reading metadata of %s: %v", src, err)
+		return
+	}
+	header, err := fileHeader(src, ".", info, nil)
+	if err != nil {
+		utils.Warn("Error reading metadata of %s: %v", src, err)
+		return
+	}
+	applyMetadata(dst, header)
+}
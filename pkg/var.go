@@ -8,9 +8,11 @@ package pkg
 
 const tmpPath = "/tmp/backup"
 const gpgExtension = "gpg"
+const ageExtension = "age"
 const dataPath = "/data"
 const dataTmpPath = "/tmp/data"
 const backupDestination = "/backup"
+const snapshotPath = "/config/snapshots"
 
 var (
 	storage          = "local"
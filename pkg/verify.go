@@ -0,0 +1,333 @@
+// Package pkg /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package pkg
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/jkaninda/volume-backup/utils"
+	"github.com/robfig/cron/v3"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// verifyResult is the outcome of the verification of a backup
+type verifyResult struct {
+	entries  int
+	checked  int
+	manifest *backupManifest
+	// failures lists the corrupted, missing or unexpected entries
+	failures []string
+}
+
+func StartVerify(cmd *cobra.Command) {
+	intro()
+	conf := initVerifyConfig(cmd)
+	if conf.cronExpression == "" {
+		if !runVerify(conf) {
+			utils.Fatal("Backup verification failed")
+		}
+		return
+	}
+	if !utils.IsValidCronExpression(conf.cronExpression) {
+		utils.Fatal("Cron expression is not valid: %s", conf.cronExpression)
+	}
+	utils.Info("Running in Scheduled mode")
+	utils.Info("Verification cron expression:  %s", conf.cronExpression)
+	runVerify(conf)
+	c := cron.New()
+	_, err := c.AddFunc(conf.cronExpression, func() {
+		runVerify(conf)
+	})
+	if err != nil {
+		utils.Fatal("Error creating verification job: %v", err)
+	}
+	c.Start()
+	utils.Info("Verification job started")
+	defer c.Stop()
+	select {}
+}
+
+// runVerify verifies the selected backups, it reports whether they are all valid
+func runVerify(conf *VerifyConfig) bool {
+	// Passphrases are read again for the next scheduled verification
+	defer wipeRestoreKeys()
+	verifier, err := newSignatureVerifier(conf.allowUnsigned)
+	if err != nil {
+		utils.Error("Error loading signing keys: %v", err)
+		utils.NotifyError(fmt.Sprintf("Error loading signing keys: %v", err))
+		return false
+	}
+	defer verifier.wipe()
+	b, err := newBackend(conf.storage, conf.remotePath, conf.source)
+	if err != nil {
+		utils.Error("Error creating %s storage: %v", conf.storage, err)
+		utils.NotifyError(fmt.Sprintf("Error creating %s storage: %v", conf.storage, err))
+		return false
+	}
+	files, err := selectVerifyFiles(conf, b)
+	if err != nil {
+		utils.Error("Error selecting backups to verify: %v", err)
+		utils.NotifyError(fmt.Sprintf("Error selecting backups to verify: %v", err))
+		return false
+	}
+	valid := true
+	for _, file := range files {
+		startTime := time.Now().Format(utils.TimeFormat())
+		utils.Info("Verifying backup %s ...", file)
+		result, err := verifyBackup(b, file, verifier)
+		deleteTemp()
+		if err == nil && len(result.failures) > 0 {
+			err = fmt.Errorf("%d corrupted or missing entries", len(result.failures))
+		}
+		if err != nil {
+			valid = false
+			utils.Error("Verification of %s failed: %v", file, err)
+			utils.NotifyError(fmt.Sprintf("Verification of backup %s failed: %v", file, err))
+			continue
+		}
+		utils.Info("Backup %s is valid, %d entries read, %d files checked", file, result.entries, result.checked)
+		utils.NotifySuccess(&utils.NotificationData{
+			File:           file,
+			Storage:        conf.storage,
+			BackupLocation: b.Location(file),
+			Source:         conf.source,
+			StartTime:      startTime,
+			EndTime:        time.Now().Format(utils.TimeFormat()),
+			Verified:       true,
+		})
+	}
+	return valid
+}
+
+// selectVerifyFiles returns the backups to verify, the given file, the latest backup or all of them
+func selectVerifyFiles(conf *VerifyConfig, b backend) ([]string, error) {
+	if conf.file != "" {
+		return []string{conf.file}, nil
+	}
+	backups, err := listBackups(b)
+	if err != nil {
+		return nil, err
+	}
+	backups = filterPrefix(backups, conf.prefix)
+	if len(backups) == 0 {
+		return nil, fmt.Errorf("no backup found")
+	}
+	if !conf.all {
+		backups = backups[len(backups)-1:]
+	}
+	files := make([]string, 0, len(backups))
+	for _, backup := range backups {
+		files = append(files, backup.Name)
+	}
+	return files, nil
+}
+
+// verifyBackup reads a backup streamed from the storage, it is decrypted and checked without restoring anything
+func verifyBackup(b backend, file string, verifier *signatureVerifier) (*verifyResult, error) {
+	if isRepositorySnapshot(file) {
+		return verifyRepository(b, file, verifier)
+	}
+	signature, err := verifier.fetch(b, file)
+	if err != nil {
+		return nil, err
+	}
+	if manifest, err := downloadPartsManifest(b, file); err == nil {
+		reader := newPartsReader(b.Get, manifest)
+		defer reader.Close()
+		return verifyArchive(file, reader, signature)
+	}
+	stream, err := b.Get(file)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %w", file, err)
+	}
+	defer stream.Close()
+	return verifyArchive(file, stream, signature)
+}
+
+// verifyArchive checks an archive stream against its signature, then decrypts and verifies it
+func verifyArchive(file string, stream io.Reader, signature *fileSignature) (*verifyResult, error) {
+	stored := signature.reader(stream)
+	reader, err := decryptStream(file, stored)
+	if err != nil {
+		return nil, stored.failed(err)
+	}
+	result, err := verifyStream(reader)
+	if err != nil {
+		return nil, stored.failed(err)
+	}
+	// The end of the stored stream is read to check the signature, the last volume and the archive checksums
+	if err := stored.finish(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// verifyStream decompresses and walks an archive, the content of each file is checked against the manifest
+func verifyStream(stream io.Reader) (*verifyResult, error) {
+	reader, codec, err := newDecompressReader(stream)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	utils.Info("Compression: %s", codec)
+	result := &verifyResult{}
+	// The complete manifest is the first member, the last one in older archives, the files are checked once the archive is read
+	sums := make(map[string]string)
+	var checksums map[string]string
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading archive: %w", err)
+		}
+		if isManifest(header) {
+			manifest, err := readManifest(tarReader)
+			if err != nil {
+				return nil, err
+			}
+			if result.manifest == nil {
+				utils.Info("Backup of %s from %s, created by version %s at %s", manifest.Source, manifest.Host, manifest.AppVersion, manifest.StartTime.Format(utils.TimeFormat()))
+			}
+			result.manifest = manifest
+			if !isManifestHeader(header) {
+				checksums = manifest.checksums()
+			}
+			continue
+		}
+		result.entries++
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, tarReader); err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", header.Name, err)
+		}
+		sums[header.Name] = hex.EncodeToString(h.Sum(nil))
+	}
+	// Compressed streams are checked at their end, after the end of the tar archive.
+	// The reader is hidden behind an io.Reader, pgzip fails when WriteTo is called after Read.
+	if _, err := io.Copy(io.Discard, struct{ io.Reader }{reader}); err != nil {
+		return nil, fmt.Errorf("error reading archive: %w", err)
+	}
+	if result.manifest == nil {
+		utils.Warn("No manifest found, the archive is readable but its files cannot be checked")
+		return result, nil
+	}
+	if checksums == nil {
+		result.fail(manifestName, "the complete manifest is missing, the archive is truncated")
+		return result, nil
+	}
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		expected, ok := checksums[name]
+		switch {
+		case !ok:
+			result.fail(name, "not listed in the manifest")
+		case expected != sums[name]:
+			result.fail(name, "checksum mismatch")
+		default:
+			result.checked++
+		}
+	}
+	var missing []string
+	for name := range checksums {
+		if _, ok := sums[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		result.fail(name, "missing from the archive")
+	}
+	return result, nil
+}
+
+// verifyRepository downloads the packs of a repository snapshot and checks every chunk it references
+func verifyRepository(b backend, file string, verifier *signatureVerifier) (*verifyResult, error) {
+	if err := download(b, file); err != nil {
+		return nil, fmt.Errorf("error downloading %s: %w", file, err)
+	}
+	if err := verifier.checkTempFile(b, file); err != nil {
+		return nil, err
+	}
+	data, err := readTempFile(file)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &repositorySnapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s: %w", file, err)
+	}
+	result := &verifyResult{entries: len(snapshot.Nodes)}
+	packs := make(map[string][]string)
+	for _, node := range snapshot.Nodes {
+		for _, hash := range node.Chunks {
+			location, ok := snapshot.Chunks[hash]
+			if !ok {
+				result.fail(node.Path, fmt.Sprintf("chunk %s not found in snapshot", hash))
+				continue
+			}
+			packs[location.Pack] = append(packs[location.Pack], hash)
+		}
+		if node.Type == "file" {
+			result.checked++
+		}
+	}
+	names := make([]string, 0, len(packs))
+	for pack := range packs {
+		names = append(names, pack)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		utils.Info("Verifying pack %d/%d ...", i+1, len(names))
+		// Packs rekeyed with another encryption are renamed, the snapshot keeps their original names
+		pack := resolveName(b, name)
+		if err := download(b, pack); err != nil {
+			result.fail(pack, fmt.Sprintf("error downloading pack: %v", err))
+			continue
+		}
+		data, err := readTempFile(pack)
+		if err != nil {
+			result.fail(pack, err.Error())
+			continue
+		}
+		verified := make(map[string]bool)
+		for _, hash := range packs[name] {
+			if verified[hash] {
+				continue
+			}
+			verified[hash] = true
+			if _, err := readChunk(data, hash, snapshot.Chunks[hash]); err != nil {
+				result.fail(pack, fmt.Sprintf("chunk %s: %v", hash, err))
+			}
+		}
+		_ = os.Remove(filepath.Join(tmpPath, pack))
+		_ = os.Remove(RemoveLastExtension(filepath.Join(tmpPath, pack)))
+	}
+	return result, nil
+}
+
+// fail records a corrupted entry
+func (r *verifyResult) fail(name, reason string) {
+	utils.Error("%s: %s", name, reason)
+	r.failures = append(r.failures, fmt.Sprintf("%s: %s", name, reason))
+}
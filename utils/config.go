@@ -19,6 +19,10 @@ type NotificationData struct {
 	Storage         string
 	BackupLocation  string
 	BackupReference string
+	// Source is the name of the backed up source, empty when the whole volume is backed up
+	Source string
+	// Verified is set when the notification reports a backup verification
+	Verified bool
 }
 type ErrorMessage struct {
 	Database        string
@@ -28,16 +32,20 @@ type ErrorMessage struct {
 }
 
 // loadMailConfig gets mail environment variables and returns MailConfig
-func loadMailConfig() *MailConfig {
+func loadMailConfig() (*MailConfig, error) {
+	password, err := GetSecret("MAIL_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
 	return &MailConfig{
 		MailHost:     os.Getenv("MAIL_HOST"),
 		MailPort:     GetIntEnv("MAIL_PORT"),
 		MailUserName: os.Getenv("MAIL_USERNAME"),
-		MailPassword: os.Getenv("MAIL_PASSWORD"),
+		MailPassword: password,
 		MailTo:       os.Getenv("MAIL_TO"),
 		MailFrom:     os.Getenv("MAIL_FROM"),
 		SkipTls:      os.Getenv("MAIL_SKIP_TLS") == "false",
-	}
+	}, nil
 
 }
 
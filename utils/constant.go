@@ -6,8 +6,16 @@
 **/
 package utils
 
-const RestoreExample = "restore"
+const RestoreExample = "restore --file backup_20231219_022941.tar.gz\n" +
+	"restore --latest --target /data/restored --strategy clean\n" +
+	"restore --latest --dry-run --output json"
 const BackupExample = "backup"
+const ListExample = "list\n" +
+	"list --output json"
+const VerifyExample = "verify --latest\n" +
+	"verify --file backup_20231219_022941.tar.gz"
+const RekeyExample = "rekey --all\n" +
+	"rekey --file backup_20231219_022941.tar.gz.gpg"
 
 const MainExample = "backup\n" +
 	"restore --file backup_20231219_022941.tar"
@@ -8,18 +8,27 @@ package utils
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"time"
 )
 
+// logOutput is the destination of the log messages
+var logOutput io.Writer = os.Stdout
+
+// SetLogOutput changes the destination of the log messages, eg: to keep the standard output for a JSON document
+func SetLogOutput(w io.Writer) {
+	logOutput = w
+}
+
 // Info message
 func Info(msg string, args ...any) {
 	var currentTime = time.Now().Format("2006/01/02 15:04:05")
 	formattedMessage := fmt.Sprintf(msg, args...)
 	if len(args) == 0 {
-		fmt.Printf("%s INFO: %s\n", currentTime, msg)
+		fmt.Fprintf(logOutput, "%s INFO: %s\n", currentTime, msg)
 	} else {
-		fmt.Printf("%s INFO: %s\n", currentTime, formattedMessage)
+		fmt.Fprintf(logOutput, "%s INFO: %s\n", currentTime, formattedMessage)
 	}
 }
 
@@ -28,9 +37,9 @@ func Warn(msg string, args ...any) {
 	var currentTime = time.Now().Format("2006/01/02 15:04:05")
 	formattedMessage := fmt.Sprintf(msg, args...)
 	if len(args) == 0 {
-		fmt.Printf("%s WARN: %s\n", currentTime, msg)
+		fmt.Fprintf(logOutput, "%s WARN: %s\n", currentTime, msg)
 	} else {
-		fmt.Printf("%s WARN: %s\n", currentTime, formattedMessage)
+		fmt.Fprintf(logOutput, "%s WARN: %s\n", currentTime, formattedMessage)
 	}
 }
 
@@ -39,18 +48,18 @@ func Error(msg string, args ...any) {
 	var currentTime = time.Now().Format("2006/01/02 15:04:05")
 	formattedMessage := fmt.Sprintf(msg, args...)
 	if len(args) == 0 {
-		fmt.Printf("%s ERROR: %s\n", currentTime, msg)
+		fmt.Fprintf(logOutput, "%s ERROR: %s\n", currentTime, msg)
 	} else {
-		fmt.Printf("%s ERROR: %s\n", currentTime, formattedMessage)
+		fmt.Fprintf(logOutput, "%s ERROR: %s\n", currentTime, formattedMessage)
 	}
 }
 func Done(msg string, args ...any) {
 	var currentTime = time.Now().Format("2006/01/02 15:04:05")
 	formattedMessage := fmt.Sprintf(msg, args...)
 	if len(args) == 0 {
-		fmt.Printf("%s INFO: %s\n", currentTime, msg)
+		fmt.Fprintf(logOutput, "%s INFO: %s\n", currentTime, msg)
 	} else {
-		fmt.Printf("%s INFO: %s\n", currentTime, formattedMessage)
+		fmt.Fprintf(logOutput, "%s INFO: %s\n", currentTime, formattedMessage)
 	}
 }
 
@@ -59,10 +68,10 @@ func Fatal(msg string, args ...any) {
 	// Fatal logs an error message and exits the program.
 	formattedMessage := fmt.Sprintf(msg, args...)
 	if len(args) == 0 {
-		fmt.Printf("%s ERROR: %s\n", currentTime, msg)
+		fmt.Fprintf(logOutput, "%s ERROR: %s\n", currentTime, msg)
 		NotifyError(msg)
 	} else {
-		fmt.Printf("%s ERROR: %s\n", currentTime, formattedMessage)
+		fmt.Fprintf(logOutput, "%s ERROR: %s\n", currentTime, formattedMessage)
 		NotifyError(formattedMessage)
 
 	}
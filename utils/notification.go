@@ -32,8 +32,12 @@ func parseTemplate[T any](data T, fileName string) (string, error) {
 }
 
 func SendEmail(subject, body string) error {
+	// Fatal sends the notifications, an error reading the mail password is returned instead of calling Fatal again
+	config, err := loadMailConfig()
+	if err != nil {
+		return err
+	}
 	Info("Start sending email notification....")
-	config := loadMailConfig()
 	emails := strings.Split(config.MailTo, ",")
 	m := mail.NewMessage()
 	m.SetHeader("From", config.MailFrom)
@@ -53,13 +57,17 @@ func SendEmail(subject, body string) error {
 }
 func sendMessage(msg string) error {
 
+	tgUrl, err := getTgUrl()
+	if err != nil {
+		return err
+	}
 	Info("Sending Telegram notification... ")
 	chatId := os.Getenv("TG_CHAT_ID")
 	body, _ := json.Marshal(map[string]string{
 		"chat_id": chatId,
 		"text":    msg,
 	})
-	url := fmt.Sprintf("%s/sendMessage", getTgUrl())
+	url := fmt.Sprintf("%s/sendMessage", tgUrl)
 	// Create an HTTP post request
 	request, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
 	if err != nil {
@@ -173,8 +181,12 @@ func NotifyError(error string) {
 	}
 }
 
-func getTgUrl() string {
-	return fmt.Sprintf("https://api.telegram.org/bot%s", os.Getenv("TG_TOKEN"))
+func getTgUrl() (string, error) {
+	token, err := GetSecret("TG_TOKEN")
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("https://api.telegram.org/bot%s", token), nil
 
 }
 func IsValidCronExpression(cronExpr string) bool {
@@ -0,0 +1,87 @@
+// Package utils /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// secretVars are the environment variables holding secrets. Their value can also be read from the file of
+// <name>_FILE, eg: a Docker secret, or from the standard output of the <name>_COMMAND shell command.
+var secretVars = []string{
+	"GPG_PASSPHRASE",
+	"NEW_GPG_PASSPHRASE",
+	"RESTORE_PRIVATE_KEY_PASSPHRASE",
+	"SIGNING_KEY_PASSPHRASE",
+	"SIGNING_HMAC_KEY",
+	"AWS_ACCESS_KEY",
+	"AWS_SECRET_KEY",
+	"SSH_PASSWORD",
+	"FTP_PASSWORD",
+	"MAIL_PASSWORD",
+	"TG_TOKEN",
+}
+
+// isSecretVar reports whether an environment variable holds a secret
+func isSecretVar(name string) bool {
+	for _, secret := range secretVars {
+		if secret == name {
+			return true
+		}
+	}
+	return false
+}
+
+// secretIsSet reports whether a secret is set, by its environment variable, its file or its command
+func secretIsSet(name string) bool {
+	return os.Getenv(name) != "" || os.Getenv(name+"_FILE") != "" || os.Getenv(name+"_COMMAND") != ""
+}
+
+// GetSecret returns the value of a secret as a string, for the credentials of clients that only take strings,
+// eg: storage and mail passwords. The string cannot be cleared, passphrases and keys are read with GetSecretBytes.
+func GetSecret(name string) (string, error) {
+	secret, err := GetSecretBytes(name)
+	defer clear(secret)
+	return string(secret), err
+}
+
+// GetSecretBytes returns the value of a secret, read from the name environment variable, the file of name_FILE
+// or the standard output of the name_COMMAND shell command. Trailing newlines of files and commands are removed.
+// The caller clears the returned slice once the secret is used.
+func GetSecretBytes(name string) ([]byte, error) {
+	value, file, command := os.Getenv(name), os.Getenv(name+"_FILE"), os.Getenv(name+"_COMMAND")
+	set := 0
+	for _, v := range []string{value, file, command} {
+		if v != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, fmt.Errorf("only one of %s, %s_FILE and %s_COMMAND can be set", name, name, name)
+	}
+	switch {
+	case file != "":
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s_FILE: %w", name, err)
+		}
+		return bytes.TrimRight(data, "\r\n"), nil
+	case command != "":
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stderr = os.Stderr
+		data, err := cmd.Output()
+		if err != nil {
+			clear(data)
+			return nil, fmt.Errorf("error running %s_COMMAND: %w", name, err)
+		}
+		return bytes.TrimRight(data, "\r\n"), nil
+	}
+	return []byte(value), nil
+}
@@ -0,0 +1,99 @@
+// Package utils /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setSecretEnv sets the value, _FILE and _COMMAND variables of a secret, empty ones are unset
+func setSecretEnv(t *testing.T, name, value, file, command string) {
+	t.Helper()
+	t.Setenv(name, value)
+	t.Setenv(name+"_FILE", file)
+	t.Setenv(name+"_COMMAND", command)
+}
+
+func TestGetSecret(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "passphrase")
+	if err := os.WriteFile(secretFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		value   string
+		file    string
+		command string
+		want    string
+		wantErr string
+	}{
+		{name: "unset", want: ""},
+		{name: "value", value: "from-env\n", want: "from-env\n"},
+		{name: "file", file: secretFile, want: "from-file"},
+		{name: "command", command: "printf 'from-command\\r\\n'", want: "from-command"},
+		{name: "command output is kept", command: "echo ' spaced '", want: " spaced "},
+		{name: "missing file", file: filepath.Join(dir, "missing"), wantErr: "error reading GPG_PASSPHRASE_FILE"},
+		{name: "failing command", command: "exit 3", wantErr: "error running GPG_PASSPHRASE_COMMAND"},
+		{name: "value and file", value: "v", file: secretFile, wantErr: "only one of"},
+		{name: "file and command", file: secretFile, command: "echo c", wantErr: "only one of"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setSecretEnv(t, "GPG_PASSPHRASE", tt.value, tt.file, tt.command)
+			got, err := GetSecretBytes("GPG_PASSPHRASE")
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Fatalf("GetSecretBytes() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("GetSecretBytes() = %q, want %q", got, tt.want)
+			}
+			if secret, err := GetSecret("GPG_PASSPHRASE"); err != nil || secret != tt.want {
+				t.Errorf("GetSecret() = %q, %v, want %q", secret, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckEnvVars(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		vars    []string
+		wantErr bool
+	}{
+		{name: "set", env: map[string]string{"AWS_S3_ENDPOINT": "s3", "AWS_SECRET_KEY": "key"}, vars: []string{"AWS_S3_ENDPOINT", "AWS_SECRET_KEY"}},
+		{name: "missing", env: map[string]string{"AWS_S3_ENDPOINT": "s3"}, vars: []string{"AWS_S3_ENDPOINT", "AWS_SECRET_KEY"}, wantErr: true},
+		{name: "secret file", env: map[string]string{"AWS_SECRET_KEY_FILE": "/run/secrets/key"}, vars: []string{"AWS_SECRET_KEY"}},
+		{name: "secret command", env: map[string]string{"SSH_PASSWORD_COMMAND": "pass show ssh"}, vars: []string{"SSH_PASSWORD"}},
+		{name: "file of a variable that is not a secret", env: map[string]string{"AWS_S3_ENDPOINT_FILE": "/run/secrets/endpoint"}, vars: []string{"AWS_S3_ENDPOINT"}, wantErr: true},
+		{name: "command of a variable that is not a secret", env: map[string]string{"SSH_USER_COMMAND": "whoami"}, vars: []string{"SSH_USER"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"AWS_S3_ENDPOINT", "AWS_SECRET_KEY", "SSH_PASSWORD", "SSH_USER"} {
+				setSecretEnv(t, name, "", "", "")
+			}
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			err := CheckEnvVars(tt.vars)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CheckEnvVars(%v) error = %v, wantErr %v", tt.vars, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -14,8 +14,20 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 )
 
+// AppVersion is the version of the application, set by the VERSION environment variable of the image
+var AppVersion = appVersion()
+
+// appVersion returns the version of the image, builds without a version are development builds
+func appVersion() string {
+	if version := os.Getenv("VERSION"); version != "" {
+		return version
+	}
+	return "development"
+}
+
 // FileExists checks if the file does exist
 func FileExists(filename string) bool {
 	info, err := os.Stat(filename)
@@ -176,12 +188,12 @@ func GetEnvVariable(envName, oldEnvName string) string {
 	return value
 }
 
-// CheckEnvVars checks if all the specified environment variables are set
+// CheckEnvVars checks if all the specified environment variables are set, secrets can be set by their file or command
 func CheckEnvVars(vars []string) error {
 	missingVars := []string{}
 
 	for _, v := range vars {
-		if os.Getenv(v) == "" {
+		if os.Getenv(v) == "" && !(isSecretVar(v) && secretIsSet(v)) {
 			missingVars = append(missingVars, v)
 		}
 	}
@@ -221,3 +233,44 @@ func GetIntEnv(envName string) int {
 	}
 	return ret
 }
+
+// ParseSize parses a size such as 512MiB, 10GB or 1048576 (bytes)
+func ParseSize(value string) (int64, error) {
+	units := []struct {
+		suffix string
+		size   int64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+		{"KB", 1000}, {"MB", 1000 * 1000}, {"GB", 1000 * 1000 * 1000}, {"TB", 1000 * 1000 * 1000 * 1000},
+		{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40}, {"B", 1},
+	}
+	value = strings.TrimSpace(value)
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(strings.ToUpper(value), strings.ToUpper(unit.suffix)) {
+			value = strings.TrimSpace(value[:len(value)-len(unit.suffix)])
+			multiplier = unit.size
+			break
+		}
+	}
+	size, err := strconv.ParseFloat(value, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(size * float64(multiplier)), nil
+}
+
+// FormatSize formats a size in bytes with binary units, eg: 1.5 GiB
+func FormatSize(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
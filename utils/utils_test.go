@@ -0,0 +1,73 @@
+// Package utils /
+/*****
+@author    Jonas Kaninda
+@license   MIT License <https://opensource.org/licenses/MIT>
+@Copyright © 2024 Jonas Kaninda
+**/
+package utils
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{value: "1048576", want: 1048576},
+		{value: "0", want: 0},
+		{value: "100B", want: 100},
+		{value: "1KiB", want: 1 << 10},
+		{value: "512MiB", want: 512 << 20},
+		{value: "10GiB", want: 10 << 30},
+		{value: "2TiB", want: 2 << 40},
+		{value: "1KB", want: 1000},
+		{value: "10MB", want: 10 * 1000 * 1000},
+		{value: "1GB", want: 1000 * 1000 * 1000},
+		{value: "1TB", want: 1000 * 1000 * 1000 * 1000},
+		{value: "1K", want: 1 << 10},
+		{value: "4G", want: 4 << 30},
+		{value: "1.5GiB", want: 3 << 29},
+		{value: "512mib", want: 512 << 20},
+		{value: " 100 MB ", want: 100 * 1000 * 1000},
+		{value: "", wantErr: true},
+		{value: "MB", wantErr: true},
+		{value: "ten", wantErr: true},
+		{value: "-1GB", wantErr: true},
+		{value: "10PB", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseSize(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSize(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseSize(%q) = %d, want %d", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		size int64
+		want string
+	}{
+		{size: 0, want: "0 B"},
+		{size: 1023, want: "1023 B"},
+		{size: 1024, want: "1.0 KiB"},
+		{size: 1536, want: "1.5 KiB"},
+		{size: 10 << 20, want: "10.0 MiB"},
+		{size: 3 << 29, want: "1.5 GiB"},
+		{size: 2 << 40, want: "2.0 TiB"},
+		{size: 2048 << 40, want: "2048.0 TiB"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := FormatSize(tt.size); got != tt.want {
+				t.Errorf("FormatSize(%d) = %q, want %q", tt.size, got, tt.want)
+			}
+		})
+	}
+}